@@ -0,0 +1,320 @@
+package admin
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyke369/golang-support/uconfig"
+	"github.com/pyke369/golang-support/ulog"
+	"github.com/pyke369/golang-support/ustr"
+
+	c "ptftp/cache"
+	"ptftp/common"
+	r "ptftp/route"
+)
+
+func bail(message string, exit int) {
+	os.Stderr.WriteString(message + " - aborting\n")
+	os.Exit(exit)
+}
+
+// objects walks the cache roots and returns the cached objects matching one of the patterns (all of them if none),
+// temporary files, metadata sidecars and quarantined contents being skipped
+func objects(patterns []*regexp.Regexp) (out []string) {
+	for _, root := range c.Roots() {
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if entry.IsDir() {
+				if path != root && strings.HasPrefix(entry.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), "_") || strings.HasPrefix(entry.Name(), ".") {
+				return nil
+			}
+			if len(patterns) == 0 {
+				out = append(out, path)
+				return nil
+			}
+			for _, pattern := range patterns {
+				if pattern.MatchString(path) {
+					out = append(out, path)
+					break
+				}
+			}
+			return nil
+		})
+	}
+
+	return out
+}
+
+func patterns(arguments []string) (out []*regexp.Regexp) {
+	for _, argument := range arguments {
+		pattern, err := regexp.Compile(argument)
+		if err != nil {
+			bail("invalid pattern "+argument, 2)
+		}
+		out = append(out, pattern)
+	}
+
+	return out
+}
+
+func age(value time.Time) string {
+	if value.IsZero() {
+		return "-"
+	}
+
+	return ustr.Duration(time.Since(value).Truncate(time.Second))
+}
+
+func list(arguments []string) {
+	for _, path := range objects(patterns(arguments)) {
+		info := make([]string, 0, 6)
+		size, fetched, state, served, hits := int64(0), time.Time{}, "unknown", time.Time{}, int64(0)
+		if value, err := os.Stat(path); err == nil {
+			size, fetched = value.Size(), value.ModTime()
+		}
+		if metadata := c.Meta(path); metadata != nil {
+			state, served, hits = "static", metadata.Served, metadata.Hits
+			if !metadata.Fetched.IsZero() {
+				fetched = metadata.Fetched
+			}
+			if metadata.Refresh > 0 {
+				state = "fresh"
+				if c.Expired(path) {
+					state = "expired"
+				}
+			}
+		}
+		info = append(info, ustr.String(ustr.Size(size), 9), ustr.String(age(fetched), 12), ustr.String(state, -7), ustr.String(age(served), 12),
+			ustr.String(strconv.FormatInt(hits, 10), 6), path)
+		os.Stdout.WriteString(strings.Join(info, "  ") + "\n")
+	}
+}
+
+// cached tells whether path is an object created by the cache (described by a sidecar) under one of the cache roots
+func cached(path string) bool {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, root := range c.Roots() {
+		if root, err := filepath.Abs(root); err == nil {
+			if relative, err := filepath.Rel(root, absolute); err == nil && filepath.IsLocal(relative) {
+				return c.Meta(path) != nil
+			}
+		}
+	}
+
+	return false
+}
+
+// objects are purged by path (relative to the current directory, like the cache policies paths) or by pattern
+func purge(arguments []string) {
+	if len(arguments) == 0 {
+		bail("missing path or pattern", 2)
+	}
+	paths, expressions := []string{}, []string{}
+	for _, argument := range arguments {
+		if info, err := os.Stat(argument); err == nil && info.Mode().IsRegular() {
+			paths = append(paths, argument)
+
+		} else {
+			expressions = append(expressions, argument)
+		}
+	}
+	if len(expressions) != 0 {
+		paths = append(paths, objects(patterns(expressions))...)
+	}
+	for _, path := range paths {
+		if !cached(path) {
+			os.Stderr.WriteString(path + ": not a cached object\n")
+			continue
+		}
+		if err := c.Purge(path); err != nil {
+			os.Stderr.WriteString(path + ": " + err.Error() + "\n")
+			continue
+		}
+		os.Stdout.WriteString("purged " + path + "\n")
+	}
+}
+
+func verify(arguments []string) {
+	failed := false
+	for _, path := range objects(patterns(arguments)) {
+		if err := c.Verify(path); err != nil {
+			if errors.Is(err, c.ErrMismatch) {
+				failed = true
+			}
+			os.Stdout.WriteString(ustr.String(err.Error(), -20) + "  " + path + "\n")
+			continue
+		}
+		os.Stdout.WriteString(ustr.String("ok", -20) + "  " + path + "\n")
+	}
+	if failed {
+		os.Exit(4)
+	}
+}
+
+// files are read from the command line or (with -) from stdin, one per line, and downloaded in turn by their
+// route cache policy
+func prefetch(config *uconfig.UConfig, logger *ulog.ULog, arguments []string) {
+	files := []string{}
+	for _, argument := range arguments {
+		if argument != "-" {
+			files = append(files, argument)
+			continue
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				files = append(files, line)
+			}
+		}
+	}
+	if len(files) == 0 {
+		bail("missing file", 2)
+	}
+	failed := false
+	for _, file := range files {
+		job := r.Job("cli", file)
+		if job == nil {
+			os.Stdout.WriteString(ustr.String("skipped", -9) + "  " + file + "\n")
+			continue
+		}
+		job.Delay = 0
+		if err := c.Download(config, logger, job); err != nil {
+			failed = true
+			os.Stdout.WriteString(ustr.String("failed", -9) + "  " + file + " (" + err.Error() + ")\n")
+			continue
+		}
+		os.Stdout.WriteString(ustr.String("cached", -9) + "  " + file + " -> " + job.Local + "\n")
+	}
+	if failed {
+		os.Exit(4)
+	}
+}
+
+// jobs lists the cache jobs states persisted by the server (pending, running and recently failed ones, along with
+// their consecutive failures and when they may be retried)
+func jobs(config *uconfig.UConfig) {
+	path := strings.TrimSpace(config.String("cache_state"))
+	if path == "" {
+		bail("cache_state not configured", 2)
+	}
+	for _, state := range c.LoadJobs(path) {
+		line := ustr.String(state.State, -7) + "  " + ustr.String(age(state.Updated), 12) + "  " + state.Job.Local + " <- " + state.Job.Remote
+		if state.State == c.StateFailed {
+			line += " (" + state.Reason + ", " + strconv.Itoa(state.Failures) + " failures, retry " + state.Retry().Format(time.DateTime) + ")"
+
+		} else if state.Failures != 0 {
+			line += " (" + strconv.Itoa(state.Failures) + " failures)"
+		}
+		os.Stdout.WriteString(line + "\n")
+	}
+}
+
+// orphans are temporary files (partial downloads and their progress) left by jobs no longer known to the server,
+// metadata sidecars of removed objects and quarantined copies older than a day; recent partial downloads are kept, as
+// they may belong to a starting job
+func clean(config *uconfig.UConfig) {
+	active := map[string]bool{}
+	if path := strings.TrimSpace(config.String("cache_state")); path != "" {
+		for _, state := range c.LoadJobs(path) {
+			if state.State != c.StateFailed {
+				active[filepath.Clean(state.Job.Local)] = true
+			}
+		}
+	}
+	for _, root := range c.Roots() {
+		quarantined := filepath.Join(root, ".quarantine") + string(filepath.Separator)
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return nil
+			}
+			name, local, orphan := entry.Name(), "", false
+			switch {
+			case strings.HasPrefix(path, quarantined):
+				info, err := entry.Info()
+				orphan = err == nil && time.Since(info.ModTime()) >= 24*time.Hour
+
+			case strings.HasPrefix(name, "._") && strings.HasSuffix(name, ".progress"):
+				local = strings.TrimSuffix(strings.TrimPrefix(name, "._"), ".progress")
+
+			case strings.HasPrefix(name, "_"):
+				local = strings.TrimPrefix(name, "_")
+
+			case strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".meta") || strings.HasSuffix(name, ".refresh") || strings.HasSuffix(name, ".meta.tmp")):
+				local = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, "."), ".tmp"), ".meta"), ".refresh")
+				_, err := os.Stat(filepath.Join(filepath.Dir(path), local))
+				orphan = os.IsNotExist(err)
+				local = ""
+			}
+			if local != "" {
+				info, err := entry.Info()
+				orphan = err == nil && time.Since(info.ModTime()) >= time.Hour && !active[filepath.Join(filepath.Dir(path), local)]
+			}
+			if orphan {
+				if err := os.Remove(path); err != nil {
+					os.Stderr.WriteString(path + ": " + err.Error() + "\n")
+					return nil
+				}
+				os.Stdout.WriteString("removed " + path + "\n")
+			}
+			return nil
+		})
+	}
+}
+
+// Run handles the cache subcommands, against the cache roots and routes of a server configuration
+func Run() {
+	if len(os.Args) < 4 {
+		bail("missing configuration or command", 2)
+	}
+	config, err := uconfig.New(os.Args[2])
+	if err != nil {
+		bail(err.Error(), 2)
+	}
+	config.SetPrefix(common.PROGNAME)
+	for _, err := range r.Load(config) {
+		os.Stderr.WriteString(err.Error() + "\n")
+	}
+	c.Configure(config)
+	logger := ulog.New("console()")
+	logger.SetOrder([]string{"scope", "event", "trigger", "remote", "local", "size", "duration", "bandwidth"})
+
+	switch command, arguments := strings.ToLower(os.Args[3]), os.Args[4:]; command {
+	case "list":
+		list(arguments)
+
+	case "purge":
+		purge(arguments)
+
+	case "verify":
+		verify(arguments)
+
+	case "prefetch":
+		prefetch(config, logger, arguments)
+
+	case "clean":
+		clean(config)
+
+	case "jobs":
+		jobs(config)
+
+	default:
+		bail("unknown command "+command, 2)
+	}
+}
@@ -1,49 +1,102 @@
 package backend
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/pyke369/golang-support/file"
 	"github.com/pyke369/golang-support/rcache"
 
 	"ptftp/common"
 )
 
-func File(source string, offset, length int64) (total int64, content []byte, err error) {
-	total = -1
+var (
+	ErrTooLarge      = errors.New("size limit exceeded")
+	ErrNoRange       = errors.New("range requests not supported")
+	ErrChanged       = errors.New("content changed during transfer")
+	ErrNotFound      = errors.New("not found")
+	ErrNotModified   = errors.New("not modified")
+	DefaultTransport = Transport{IdleConnections: 64, IdleTimeout: 90 * time.Second, HTTP2: true, TLS: TLS{MinVersion: tls.VersionTLS12}}
+	clients          = struct {
+		sync.Mutex
+		pool map[string]*http.Client
+	}{pool: map[string]*http.Client{}}
+)
 
-	info, err := os.Stat(source)
-	if err != nil {
-		return total, content, err
+// Transport holds the connection pooling and TLS settings shared by all requests to the same origin
+type Transport struct {
+	IdleConnections    int
+	ConnectionsPerHost int
+	IdleTimeout        time.Duration
+	HTTP2              bool
+	TLS                TLS
+}
+
+type TLS struct {
+	Verify     bool
+	CA         string
+	Cert       string
+	Key        string
+	MinVersion uint16
+	ServerName string
+}
+
+type Upload struct {
+	target    string
+	limit     int64
+	size      int64
+	handle    *os.File
+	overwrite bool
+	done      bool
+}
+
+// OpenFile opens a regular file once for a whole transfer, the descriptor pinning the file identity even if it is
+// replaced or removed in the meantime
+func OpenFile(source string) (handle *os.File, info os.FileInfo, err error) {
+	if info, err = os.Stat(source); err != nil {
+		return nil, nil, err
 	}
 	if !info.Mode().IsRegular() {
-		return total, content, errors.New("not a regular file")
+		return nil, nil, errors.New("not a regular file")
 	}
-	if lines := file.Read(filepath.Join(filepath.Dir(source), "."+filepath.Base(source)+".refresh")); len(lines) != 0 {
-		if refresh, err := strconv.Atoi(lines[0]); err == nil && refresh > 0 && int(time.Since(info.ModTime())/time.Second) >= refresh {
-			os.Remove(source)
-		}
+	if handle, err = os.Open(source); err != nil {
+		return nil, nil, err
 	}
-	total = info.Size()
-	if offset+length > total {
-		length = total - offset
+	if info, err = handle.Stat(); err != nil || !info.Mode().IsRegular() {
+		handle.Close()
+		return nil, nil, errors.New("not a regular file")
 	}
 
-	handle, err := os.Open(source)
+	return handle, info, nil
+}
+
+func File(source string, offset, length int64) (total int64, content []byte, err error) {
+	total = -1
+
+	handle, info, err := OpenFile(source)
 	if err != nil {
 		return total, content, err
 	}
 	defer handle.Close()
+	total = info.Size()
+	if offset+length > total {
+		length = total - offset
+	}
+
 	content = make([]byte, length)
 	read, err := handle.ReadAt(content, offset)
 	content = content[:read]
@@ -54,26 +107,167 @@ func File(source string, offset, length int64) (total int64, content []byte, err
 	return total, content, nil
 }
 
-func HTTP(source string, offset, length int64, timeout int, headers map[string]string, target ...*os.File) (total int64, content []byte, err error) {
-	total = -1
+func TLSVersion(in string) uint16 {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(in)), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10
+
+	case "1.1", "11":
+		return tls.VersionTLS11
+
+	case "1.3", "13":
+		return tls.VersionTLS13
+	}
+
+	return tls.VersionTLS12
+}
+
+func (t *TLS) config() (config *tls.Config, err error) {
+	config = &tls.Config{InsecureSkipVerify: !t.Verify, MinVersion: t.MinVersion, ServerName: t.ServerName}
+	if t.CA != "" {
+		content, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, errors.New("no certificate found in " + t.CA)
+		}
+	}
+	if t.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// Check tells whether the TLS settings (CA bundle, client certificate and key) can be loaded
+func (t *Transport) Check() error {
+	_, err := t.TLS.config()
+
+	return err
+}
+
+func client(source string, transport *Transport) (*http.Client, error) {
+	if transport == nil {
+		transport = &DefaultTransport
+	}
+	key := source
+	if parsed, err := url.Parse(source); err == nil {
+		key = parsed.Scheme + "://" + parsed.Host
+	}
+	key += fmt.Sprintf("|%+v", *transport)
 
-	request, _ := http.NewRequest(http.MethodGet, source, http.NoBody)
+	clients.Lock()
+	defer clients.Unlock()
+	if clients.pool[key] == nil {
+		config, err := transport.TLS.config()
+		if err != nil {
+			return nil, err
+		}
+		clients.pool[key] = &http.Client{
+			Transport: &http.Transport{
+				DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				TLSClientConfig:       config,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: time.Second,
+				ForceAttemptHTTP2:     transport.HTTP2,
+				MaxIdleConns:          transport.IdleConnections,
+				MaxIdleConnsPerHost:   transport.IdleConnections,
+				MaxConnsPerHost:       transport.ConnectionsPerHost,
+				IdleConnTimeout:       transport.IdleTimeout,
+			},
+		}
+	}
+
+	return clients.pool[key], nil
+}
+
+func do(ctx context.Context, source *Request, headers map[string]string) (response *http.Response, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, source.Target, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
 	request.Header.Add("User-Agent", common.PROGNAME+"/"+common.PROGVER)
-	request.Header.Add("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10))
 	for name, value := range headers {
 		request.Header.Add(name, value)
 	}
+	for name, value := range source.Headers {
+		request.Header.Add(name, value)
+	}
+	if source.ETag != "" && !strings.HasPrefix(source.ETag, "W/") {
+		request.Header.Set("If-Match", source.ETag)
+
+	} else if source.Modified != "" {
+		request.Header.Set("If-Unmodified-Since", source.Modified)
+	}
+	client, err := client(source.Target, source.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if response, err = client.Do(request); err != nil {
+		return nil, err
+	}
+	if err = pin(source, response); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+
+	return response, nil
+}
 
-	client := &http.Client{
-		Timeout:   time.Duration(timeout) * time.Second,
-		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+// pin records the validators of the first response, later responses (each chunk being fetched with its own request)
+// having to carry the same ones; preconditions are sent with If-Match/If-Unmodified-Since rather than If-Range, the
+// full response returned by the latter on mismatch being indistinguishable from an origin ignoring ranges
+func pin(source *Request, response *http.Response) error {
+	if response.StatusCode == http.StatusPreconditionFailed {
+		return ErrChanged
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return nil
 	}
-	response, err := client.Do(request)
+	etag, modified := response.Header.Get("ETag"), response.Header.Get("Last-Modified")
+	if source.ETag == "" && source.Modified == "" {
+		source.ETag, source.Modified = etag, modified
+		return nil
+	}
+	if (source.ETag != "" && etag != "" && etag != source.ETag) || (source.Modified != "" && modified != "" && modified != source.Modified) {
+		return ErrChanged
+	}
+
+	return nil
+}
+
+// HTTP fetches a range of the remote content, returning ErrNoRange (and the content size if announced) when
+// the origin ignores range requests
+func HTTP(source *Request, offset, length int64, target ...io.WriterAt) (total int64, content []byte, err error) {
+	total = -1
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(source.Timeout)*time.Second)
+	defer cancel()
+	response, err := do(ctx, source, map[string]string{"Range": "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)})
 	if err != nil {
 		return total, content, err
 	}
-	defer response.Body.Close()
+	defer func() {
+		// drain what is left of a (small) body, so the connection goes back to the idle pool
+		io.CopyN(io.Discard, response.Body, 64<<10)
+		response.Body.Close()
+	}()
 
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		return total, content, ErrNotFound
+	}
+	if response.StatusCode == http.StatusNotModified {
+		return total, content, ErrNotModified
+	}
+	if response.StatusCode == http.StatusOK {
+		return response.ContentLength, content, ErrNoRange
+	}
 	if response.StatusCode != http.StatusPartialContent {
 		return total, content, errors.New("http status " + strconv.Itoa(response.StatusCode))
 	}
@@ -90,7 +284,7 @@ func HTTP(source string, offset, length int64, timeout int, headers map[string]s
 		total = end - begin + 1
 
 		content = make([]byte, 64<<10)
-		for begin < end {
+		for begin <= end {
 			read, err := response.Body.Read(content)
 			if read > 0 {
 				if _, err := target[0].WriteAt(content[:read], begin); err != nil {
@@ -114,6 +308,52 @@ func HTTP(source string, offset, length int64, timeout int, headers map[string]s
 	return total, content, nil
 }
 
+type stream struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (s *stream) Close() error {
+	err := s.ReadCloser.Close()
+	s.cancel()
+
+	return err
+}
+
+// Stream issues a plain (non-range) request, the returned body streaming the whole content (total being -1 when
+// the origin does not announce it)
+func Stream(source *Request) (body io.ReadCloser, total int64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	response, err := do(ctx, source, nil)
+	if err != nil {
+		cancel()
+		return nil, -1, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		cancel()
+		return nil, -1, errors.New("http status " + strconv.Itoa(response.StatusCode))
+	}
+
+	return &stream{ReadCloser: response.Body, cancel: cancel}, response.ContentLength, nil
+}
+
+// Header returns a response header of the remote content (only its first byte being requested)
+func Header(source *Request, name string) (value string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(source.Timeout)*time.Second)
+	defer cancel()
+	response, err := do(ctx, source, map[string]string{"Range": "bytes=0-0"})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return "", errors.New("http status " + strconv.Itoa(response.StatusCode))
+	}
+
+	return response.Header.Get(name), nil
+}
+
 func Exec(source string, timeout int, env []string) (total int64, content []byte, err error) {
 	total = -1
 
@@ -146,3 +386,70 @@ func Exec(source string, timeout int, env []string) (total int64, content []byte
 
 	return total, content, nil
 }
+
+func UploadFile(target string, limit int64, create, overwrite bool) (upload *Upload, err error) {
+	if info, err := os.Stat(target); err == nil {
+		if !info.Mode().IsRegular() {
+			return nil, errors.New("not a regular file")
+		}
+		if !overwrite {
+			return nil, os.ErrExist
+		}
+
+	} else if !create {
+		return nil, os.ErrPermission
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return nil, err
+	}
+	handle, err := os.CreateTemp(filepath.Dir(target), "_"+filepath.Base(target)+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upload{target: target, limit: limit, handle: handle, overwrite: overwrite}, nil
+}
+
+func (u *Upload) Write(content []byte) (written int, err error) {
+	if u.limit > 0 && u.size+int64(len(content)) > u.limit {
+		return 0, ErrTooLarge
+	}
+	written, err = u.handle.Write(content)
+	u.size += int64(written)
+
+	return written, err
+}
+
+func (u *Upload) Size() int64 {
+	return u.size
+}
+
+func (u *Upload) Commit() error {
+	u.done = true
+	if err := u.handle.Close(); err != nil {
+		os.Remove(u.handle.Name())
+		return err
+	}
+	os.Chmod(u.handle.Name(), 0o644)
+	if u.overwrite {
+		return os.Rename(u.handle.Name(), u.target)
+	}
+
+	// without overwrite, the file is linked into place (failing if another upload created it in the meantime)
+	err := os.Link(u.handle.Name(), u.target)
+	os.Remove(u.handle.Name())
+	if errors.Is(err, os.ErrExist) {
+		return os.ErrExist
+	}
+
+	return err
+}
+
+func (u *Upload) Abort() {
+	if u.done {
+		return
+	}
+	u.done = true
+	u.handle.Close()
+	os.Remove(u.handle.Name())
+}
@@ -0,0 +1,37 @@
+package backend
+
+import (
+	"sync"
+)
+
+// concurrent fetches of the same key are coalesced into a single one, all callers sharing its (read-only) result
+type flight struct {
+	done    chan struct{}
+	content []byte
+	err     error
+}
+
+var flights = struct {
+	sync.Mutex
+	entries map[string]*flight
+}{entries: map[string]*flight{}}
+
+func share(key string, fetch func() ([]byte, error)) ([]byte, error) {
+	flights.Lock()
+	if entry := flights.entries[key]; entry != nil {
+		flights.Unlock()
+		<-entry.done
+		return entry.content, entry.err
+	}
+	entry := &flight{done: make(chan struct{})}
+	flights.entries[key] = entry
+	flights.Unlock()
+
+	entry.content, entry.err = fetch()
+	flights.Lock()
+	delete(flights.entries, key)
+	flights.Unlock()
+	close(entry.done)
+
+	return entry.content, entry.err
+}
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hot objects: small contents kept in memory (least recently used ones being evicted first), file backed ones being
+// checked against the file size and modification time, other ones expiring after a TTL (not cached when zero)
+type object struct {
+	key      string
+	content  []byte
+	file     bool
+	size     int64
+	modified time.Time
+	expires  time.Time
+}
+
+var (
+	objects = struct {
+		sync.Mutex
+		entries map[string]*list.Element
+		order   *list.List
+		size    int64
+		limit   int64
+		max     int64
+		ttl     time.Duration
+	}{entries: map[string]*list.Element{}, order: list.New()}
+	hits, misses atomic.Int64
+)
+
+func Hot(limit, max int64, ttl time.Duration) {
+	objects.Lock()
+	objects.limit, objects.max, objects.ttl = limit, max, ttl
+	objects.Unlock()
+}
+
+func HotStats() (hit, miss, count, size int64) {
+	objects.Lock()
+	defer objects.Unlock()
+
+	return hits.Load(), misses.Load(), int64(len(objects.entries)), objects.size
+}
+
+func hotKey(request *Request) string {
+	return request.Mode + "|" + request.Target + "|" + strings.Join(request.Env, "|")
+}
+
+func unhot(element *list.Element) {
+	entry := element.Value.(*object)
+	objects.order.Remove(element)
+	delete(objects.entries, entry.key)
+	objects.size -= int64(len(entry.content))
+}
+
+// Memory returns the in-memory copy of the requested content if it is still valid, nil otherwise
+func Memory(request *Request) Backend {
+	objects.Lock()
+	if objects.limit <= 0 || (request.Mode != "file" && objects.ttl <= 0) {
+		objects.Unlock()
+		return nil
+	}
+	key := hotKey(request)
+	element := objects.entries[key]
+	objects.Unlock()
+
+	if element != nil {
+		entry, valid := element.Value.(*object), true
+		if entry.file {
+			info, err := os.Stat(request.Target)
+			valid = err == nil && info.Size() == entry.size && info.ModTime().Equal(entry.modified)
+
+		} else {
+			valid = time.Now().Before(entry.expires)
+		}
+		objects.Lock()
+		defer objects.Unlock()
+		if objects.entries[key] == element {
+			if valid {
+				objects.order.MoveToFront(element)
+				hits.Add(1)
+				return &memoryBackend{content: entry.content}
+			}
+			unhot(element)
+		}
+	}
+
+	return nil
+}
+
+// Remember keeps a copy of small contents in memory, returning a memory backend in place of the (then closed)
+// original one; misses are only accounted here, for the contents that could have been served from memory
+func Remember(request *Request, backend Backend, size int64) Backend {
+	objects.Lock()
+	limit, max, ttl := objects.limit, objects.max, objects.ttl
+	objects.Unlock()
+	filer, file := backend.(Filer)
+	if limit <= 0 || size < 0 || size > max || size > limit || (!file && ttl <= 0) {
+		return backend
+	}
+	misses.Add(1)
+	entry := &object{key: hotKey(request), content: make([]byte, size), file: file, expires: time.Now().Add(ttl)}
+	if file {
+		handle := filer.File()
+		if handle == nil {
+			return backend
+		}
+		info, err := handle.Stat()
+		if err != nil {
+			return backend
+		}
+		entry.size, entry.modified = info.Size(), info.ModTime()
+	}
+	if read, err := backend.ReadAt(entry.content, 0); int64(read) != size || (err != nil && err != io.EOF) {
+		return backend
+	}
+	backend.Close()
+
+	objects.Lock()
+	if element := objects.entries[entry.key]; element != nil {
+		unhot(element)
+	}
+	for objects.size+size > objects.limit && objects.order.Len() != 0 {
+		unhot(objects.order.Back())
+	}
+	objects.entries[entry.key] = objects.order.PushFront(entry)
+	objects.size += size
+	objects.Unlock()
+
+	return &memoryBackend{content: entry.content}
+}
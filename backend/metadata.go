@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// remote content metadata (size and validators, or absence) learned from size probes, kept per target for the
+// backend configured TTL
+type metadata struct {
+	total    int64
+	etag     string
+	modified string
+	missing  bool
+	norange  bool
+	expires  time.Time
+}
+
+var metadatas = struct {
+	sync.RWMutex
+	entries map[string]*metadata
+}{entries: map[string]*metadata{}}
+
+func lookup(target string) *metadata {
+	metadatas.RLock()
+	entry := metadatas.entries[target]
+	metadatas.RUnlock()
+	if entry != nil && time.Now().After(entry.expires) {
+		forget(target)
+		return nil
+	}
+
+	return entry
+}
+
+func remember(target string, ttl time.Duration, entry *metadata) {
+	if ttl <= 0 {
+		return
+	}
+	entry.expires = time.Now().Add(ttl)
+	metadatas.Lock()
+	if len(metadatas.entries) >= 64<<10 {
+		for target, entry := range metadatas.entries {
+			if time.Now().After(entry.expires) {
+				delete(metadatas.entries, target)
+			}
+		}
+	}
+	metadatas.entries[target] = entry
+	metadatas.Unlock()
+}
+
+func forget(target string) {
+	metadatas.Lock()
+	delete(metadatas.entries, target)
+	metadatas.Unlock()
+}
@@ -0,0 +1,518 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyke369/golang-support/uconfig"
+
+	"ptftp/common"
+)
+
+// Request describes what a backend or upload sink is opened for: Config and Path (the backend configuration
+// section) let third-party backends read their own settings, ETag and Modified pin the remote content version
+// (MetadataTTL being how long the remote size and validators may be reused by later requests)
+type Request struct {
+	Mode        string
+	Target      string
+	Headers     map[string]string
+	Env         []string
+	Timeout     int
+	Transport   *Transport
+	NoRange     bool
+	Limit       int64
+	Create      bool
+	Overwrite   bool
+	Config      *uconfig.UConfig
+	Path        string
+	ETag        string
+	Modified    string
+	MetadataTTL time.Duration
+}
+
+// Backend is a readable content source, ReadAt following the io.ReaderAt contract
+type Backend interface {
+	Stat() (size int64, err error)
+	ReadAt(content []byte, offset int64) (read int, err error)
+	Close() error
+}
+
+// Filer is implemented by backends reading from a local file, front-ends then streaming straight from the descriptor
+// (letting the runtime use sendfile/splice); File returns nil when the content is not (or no longer) available this way
+type Filer interface {
+	File() *os.File
+}
+
+// Versioned is implemented by backends pinned to a version of a remote content, identified by its validators (empty
+// when the origin does not provide any)
+type Versioned interface {
+	Version() (etag, modified string)
+}
+
+// Sink is a writable content target, only made visible on Commit
+type Sink interface {
+	Write(content []byte) (written int, err error)
+	Size() int64
+	Commit() error
+	Abort()
+}
+
+type Opener func(request *Request) (Backend, error)
+type SinkOpener func(request *Request) (Sink, error)
+
+var (
+	ErrUnknownMode = errors.New("unknown backend mode")
+	lock           sync.RWMutex
+	backends       = map[string]Opener{}
+	sinks          = map[string]SinkOpener{}
+)
+
+func init() {
+	Register("file", func(request *Request) (Backend, error) {
+		return &fileBackend{source: request.Target}, nil
+	})
+	Register("http", func(request *Request) (Backend, error) {
+		return &httpBackend{request: request, total: -1}, nil
+	})
+	Register("exec", func(request *Request) (Backend, error) {
+		total, content, err := Exec(request.Target, request.Timeout, request.Env)
+		if err != nil || total < 0 {
+			return nil, errors.Join(errors.New("command failed"), err)
+		}
+		return &memoryBackend{content: content}, nil
+	})
+	RegisterSink("file", func(request *Request) (Sink, error) {
+		return UploadFile(request.Target, request.Limit, request.Create, request.Overwrite)
+	})
+}
+
+func Register(mode string, opener Opener) {
+	lock.Lock()
+	backends[mode] = opener
+	lock.Unlock()
+}
+
+func RegisterSink(mode string, opener SinkOpener) {
+	lock.Lock()
+	sinks[mode] = opener
+	lock.Unlock()
+}
+
+func Modes() (modes []string) {
+	lock.RLock()
+	for mode := range backends {
+		modes = append(modes, mode)
+	}
+	lock.RUnlock()
+	slices.Sort(modes)
+
+	return modes
+}
+
+func Open(request *Request) (Backend, error) {
+	lock.RLock()
+	opener := backends[request.Mode]
+	lock.RUnlock()
+	if opener == nil {
+		return nil, ErrUnknownMode
+	}
+
+	return opener(request)
+}
+
+func OpenSink(request *Request) (Sink, error) {
+	lock.RLock()
+	opener := sinks[request.Mode]
+	lock.RUnlock()
+	if opener == nil {
+		return nil, ErrUnknownMode
+	}
+
+	return opener(request)
+}
+
+// the file is opened once, its size and modification time being checked against the ones seen when opening
+// (the descriptor itself pinning the inode)
+type fileBackend struct {
+	source string
+	handle *os.File
+	info   os.FileInfo
+}
+
+func (b *fileBackend) Stat() (size int64, err error) {
+	if b.handle == nil {
+		if b.handle, b.info, err = OpenFile(b.source); err != nil {
+			return -1, err
+		}
+	}
+
+	return b.info.Size(), nil
+}
+
+func (b *fileBackend) ReadAt(content []byte, offset int64) (read int, err error) {
+	if _, err := b.Stat(); err != nil {
+		return 0, err
+	}
+	if info, err := b.handle.Stat(); err != nil || info.Size() != b.info.Size() || !info.ModTime().Equal(b.info.ModTime()) {
+		return 0, ErrChanged
+	}
+	if offset >= b.info.Size() {
+		return 0, io.EOF
+	}
+
+	if read, err = b.handle.ReadAt(content[:min(int64(len(content)), b.info.Size()-offset)], offset); err == nil && read < len(content) {
+		err = io.EOF
+	}
+
+	return read, err
+}
+
+func (b *fileBackend) File() *os.File {
+	if _, err := b.Stat(); err != nil {
+		return nil
+	}
+	if info, err := b.handle.Stat(); err != nil || info.Size() != b.info.Size() || !info.ModTime().Equal(b.info.ModTime()) {
+		return nil
+	}
+
+	return b.handle
+}
+
+func (b *fileBackend) Close() error {
+	if b.handle != nil {
+		return b.handle.Close()
+	}
+
+	return nil
+}
+
+// the first 64KB fetched when sizing the remote file are kept, sparing another request for small files, as well as the
+// last fetched chunk; origins ignoring range requests are downloaded once into a spool shared by all transfers
+type httpBackend struct {
+	request *Request
+	total   int64
+	head    []byte
+	chunk   []byte
+	index   int64
+	spool   *spool
+}
+
+func (b *httpBackend) Stat() (size int64, err error) {
+	if b.total < 0 {
+		if entry := lookup(b.request.Target); entry != nil {
+			if entry.missing {
+				return -1, ErrNotFound
+			}
+			b.total, b.request.ETag, b.request.Modified = entry.total, entry.etag, entry.modified
+			if entry.norange || b.request.NoRange {
+				b.spool = openSpool(b.request, b.total)
+			}
+			return b.total, nil
+		}
+		if !b.request.NoRange {
+			if b.total, b.head, err = HTTP(b.request, 0, 64<<10); err == nil {
+				remember(b.request.Target, b.request.MetadataTTL, &metadata{total: b.total, etag: b.request.ETag, modified: b.request.Modified})
+				return b.total, nil
+			}
+			if errors.Is(err, ErrNotFound) {
+				remember(b.request.Target, b.request.MetadataTTL, &metadata{missing: true})
+			}
+			if !errors.Is(err, ErrNoRange) {
+				return -1, err
+			}
+
+		} else {
+			// the size (and validators) are read from the response headers, the body being left for the spool
+			body, total, err := Stream(b.request)
+			if err != nil {
+				return -1, err
+			}
+			body.Close()
+			b.total = total
+		}
+		b.spool = openSpool(b.request, b.total)
+		if b.total < 0 {
+			// no announced size, the whole content has to be received to know it
+			if b.total, err = b.spool.size(); err != nil {
+				return -1, err
+			}
+		}
+		remember(b.request.Target, b.request.MetadataTTL, &metadata{total: b.total, etag: b.request.ETag, modified: b.request.Modified, norange: true})
+	}
+
+	return b.total, nil
+}
+
+func (b *httpBackend) ReadAt(content []byte, offset int64) (read int, err error) {
+	if _, err := b.Stat(); err != nil {
+		return 0, err
+	}
+	if b.spool != nil {
+		return b.spool.ReadAt(content, offset)
+	}
+	if offset >= b.total {
+		return 0, io.EOF
+	}
+	length := min(int64(len(content)), b.total-offset)
+	if offset+length <= int64(len(b.head)) {
+		read = copy(content, b.head[offset:offset+length])
+
+	} else {
+		for int64(read) < length {
+			index := (offset + int64(read)) / b.size()
+			if b.chunk == nil || index != b.index {
+				chunk, err := b.fetch(index)
+				if errors.Is(err, ErrChanged) {
+					forget(b.request.Target)
+				}
+				if errors.Is(err, ErrNoRange) {
+					// some origins only honor range requests not covering the whole content
+					b.spool = openSpool(b.request, b.total)
+					return b.spool.ReadAt(content, offset)
+				}
+				if err != nil {
+					return read, err
+				}
+				b.chunk, b.index = chunk, index
+			}
+			read += copy(content[read:length], b.chunk[offset+int64(read)-index*b.size():])
+		}
+	}
+	if read < len(content) {
+		err = io.EOF
+	}
+
+	return read, err
+}
+
+func (b *httpBackend) size() int64 {
+	if b.request.Config != nil {
+		return b.request.Config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20)
+	}
+
+	return 4 << 20
+}
+
+// remote content is fetched in block_size aligned chunks, shared by all transfers of the same content version
+func (b *httpBackend) fetch(index int64) (chunk []byte, err error) {
+	size := b.size()
+	begin, length := index*size, min(size, b.total-index*size)
+	key := strings.Join([]string{b.request.Target, b.request.ETag, b.request.Modified, strconv.FormatInt(b.total, 10),
+		strconv.FormatInt(begin, 10), strconv.FormatInt(length, 10)}, "|")
+
+	return share(key, func() ([]byte, error) {
+		total, chunk, err := HTTP(b.request, begin, length)
+		if err == nil && total != b.total {
+			// size learned from a stale metadata entry
+			err = ErrChanged
+		}
+		if err == nil && int64(len(chunk)) != length {
+			err = errors.New("invalid content size")
+		}
+
+		return chunk, err
+	})
+}
+
+func (b *httpBackend) Version() (etag, modified string) {
+	return b.request.ETag, b.request.Modified
+}
+
+func (b *httpBackend) Close() error {
+	if b.spool != nil {
+		b.spool.release()
+	}
+
+	return nil
+}
+
+// spool receives the whole content in an unlinked temporary file, readers only waiting for the parts they need; spools
+// are shared by all transfers of the same content version, the download only starting with the first read
+type spool struct {
+	sync.Mutex
+	cond    *sync.Cond
+	once    sync.Once
+	key     string
+	request Request
+	users   int
+	body    io.ReadCloser
+	handle  *os.File
+	total   int64
+	written int64
+	done    bool
+	err     error
+}
+
+var spools = struct {
+	sync.Mutex
+	entries map[string]*spool
+}{entries: map[string]*spool{}}
+
+func openSpool(request *Request, total int64) *spool {
+	key := strings.Join([]string{request.Target, request.ETag, request.Modified, strconv.FormatInt(total, 10)}, "|")
+	spools.Lock()
+	defer spools.Unlock()
+	s := spools.entries[key]
+	if s == nil {
+		s = &spool{key: key, request: *request, total: total}
+		s.cond = sync.NewCond(s)
+		spools.entries[key] = s
+	}
+	s.users++
+
+	return s
+}
+
+func (s *spool) start() {
+	s.once.Do(func() {
+		body, total, err := Stream(&s.request)
+		if err == nil && s.total >= 0 && total >= 0 && total != s.total {
+			body.Close()
+			err = ErrChanged
+		}
+		var handle *os.File
+		if err == nil {
+			if handle, err = os.CreateTemp("", common.PROGNAME+"-*"); err != nil {
+				body.Close()
+
+			} else {
+				os.Remove(handle.Name())
+			}
+		}
+		s.Lock()
+		if err != nil {
+			s.done, s.err = true, err
+
+		} else {
+			s.body, s.handle = body, handle
+			if s.total < 0 {
+				s.total = total
+			}
+		}
+		s.cond.Broadcast()
+		s.Unlock()
+		if err == nil {
+			go s.receive()
+		}
+	})
+}
+
+func (s *spool) receive() {
+	buffer := make([]byte, 64<<10)
+	for {
+		read, err := s.body.Read(buffer)
+		if read > 0 {
+			if _, err := s.handle.WriteAt(buffer[:read], s.written); err != nil {
+				s.finish(err)
+				return
+			}
+			s.Lock()
+			s.written += int64(read)
+			s.cond.Broadcast()
+			s.Unlock()
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			s.finish(err)
+			return
+		}
+	}
+}
+
+func (s *spool) finish(err error) {
+	s.body.Close()
+	s.Lock()
+	if err == nil && s.total >= 0 && s.written != s.total {
+		err = errors.New("invalid content size")
+	}
+	if s.total < 0 {
+		s.total = s.written
+	}
+	s.done, s.err = true, err
+	s.cond.Broadcast()
+	s.Unlock()
+}
+
+func (s *spool) size() (int64, error) {
+	s.start()
+	s.Lock()
+	defer s.Unlock()
+	for s.total < 0 && !s.done {
+		s.cond.Wait()
+	}
+
+	return s.total, s.err
+}
+
+func (s *spool) ReadAt(content []byte, offset int64) (read int, err error) {
+	s.start()
+	s.Lock()
+	for s.written < min(offset+int64(len(content)), s.total) && !s.done {
+		s.cond.Wait()
+	}
+	written, failure := s.written, s.err
+	s.Unlock()
+
+	if failure == nil {
+		failure = io.EOF
+	}
+	if offset >= written {
+		return 0, failure
+	}
+	if read, err = s.handle.ReadAt(content[:min(int64(len(content)), written-offset)], offset); err == nil && read < len(content) {
+		err = failure
+	}
+
+	return read, err
+}
+
+// release stops the download and removes the spool once its last transfer is done with it
+func (s *spool) release() {
+	spools.Lock()
+	if s.users--; s.users > 0 {
+		spools.Unlock()
+		return
+	}
+	if spools.entries[s.key] == s {
+		delete(spools.entries, s.key)
+	}
+	spools.Unlock()
+	s.Lock()
+	body, handle := s.body, s.handle
+	s.Unlock()
+	if body != nil {
+		body.Close()
+		handle.Close()
+	}
+}
+
+type memoryBackend struct {
+	content []byte
+}
+
+func (b *memoryBackend) Stat() (size int64, err error) {
+	return int64(len(b.content)), nil
+}
+
+func (b *memoryBackend) ReadAt(content []byte, offset int64) (read int, err error) {
+	if offset >= int64(len(b.content)) {
+		return 0, io.EOF
+	}
+	if read = copy(content, b.content[offset:]); read < len(content) {
+		err = io.EOF
+	}
+
+	return read, err
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
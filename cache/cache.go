@@ -1,11 +1,15 @@
 package cache
 
 import (
+	"errors"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pyke369/golang-support/file"
@@ -21,104 +25,246 @@ type Job struct {
 	Remote      string
 	Local       string
 	Headers     map[string]string
+	Transport   *b.Transport
+	NoRange     bool
 	Delay       time.Duration
 	Concurrency int
 	Refresh     int
+	Revalidate  bool
+	Checksum    *Checksum
+	Windows     []string
+	Policy      string
+	Connections int
+	Bandwidth   int64
 }
 
-var (
-	jobs chan *Job
-)
+// downloads of the same object (by the server or the command line) are serialized by a lock on its temporary file,
+// which must still be there once locked (and not renamed into place by the download holding the lock until then)
+func lock(handle *os.File, target string) error {
+	if syscall.Flock(int(handle.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+		return errors.New("download already running")
+	}
+	locked, err1 := handle.Stat()
+	current, err2 := os.Stat(target)
+	if err1 != nil || err2 != nil || !os.SameFile(locked, current) {
+		return errors.New("download already running")
+	}
 
-func Queue(job *Job) {
-	select {
-	case jobs <- job:
+	return nil
+}
 
-	default:
+// partial downloads are kept along with their progress (the remote content version and the ranges already written),
+// to be resumed by a later job (even after a restart); failed ranges are retried with an exponential backoff
+func Download(config *uconfig.UConfig, logger *ulog.ULog, job *Job) error {
+	root := filepath.Dir(job.Local)
+	target, state := filepath.Join(root, "_"+filepath.Base(job.Local)), filepath.Join(root, "._"+filepath.Base(job.Local)+".progress")
+	if job.Delay != 0 {
+		time.Sleep(job.Delay + (job.Delay / 10) - time.Duration(rand.Int63n(int64(job.Delay/5))))
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
 	}
-}
 
-func Run(config *uconfig.UConfig, logger *ulog.ULog) {
-	workers := int(config.IntegerBounds("cache_workers", 32, 1, 32))
-	jobs = make(chan *Job, workers*8)
-	for index := 1; index <= workers; index++ {
+	// expired copies are revalidated against the origin, and only replaced (atomically, transfers in progress keeping
+	// the previous version) if the remote content has changed
+	if job.Revalidate {
+		if metadata := Meta(job.Local); metadata != nil && metadata.ETag+metadata.Modified != "" && file.IsRegular(job.Local) != nil {
+			headers := map[string]string{}
+			for name, value := range job.Headers {
+				headers[name] = value
+			}
+			if metadata.ETag != "" {
+				headers["If-None-Match"] = metadata.ETag
+			}
+			if metadata.Modified != "" {
+				headers["If-Modified-Since"] = metadata.Modified
+			}
+			release := acquire(job, job.Remote)
+			_, _, err := b.HTTP(&b.Request{Target: job.Remote, Headers: headers, Timeout: 10, Transport: job.Transport}, 0, 1)
+			release()
+			if errors.Is(err, b.ErrNotModified) {
+				describe(job.Local, func(metadata *Metadata) {
+					metadata.Refresh, metadata.Validated = job.Refresh, time.Now()
+				})
+				logger.Info(map[string]any{"scope": "cache", "event": "revalidate", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
+					"modified": false})
+				return nil
+			}
+		}
+	}
+
+	// origins ignoring range requests are downloaded in a single stream
+	request := &b.Request{Target: job.Remote, Headers: job.Headers, Timeout: 10, Transport: job.Transport, NoRange: job.NoRange}
+	size, err := int64(-1), b.ErrNoRange
+	if !job.NoRange {
+		release := acquire(job, job.Remote)
+		size, _, err = b.HTTP(request, 0, 1)
+		release()
+	}
+	if err != nil && !errors.Is(err, b.ErrNoRange) {
+		return err
+	}
+	streamed := err != nil
+	if size == 0 {
+		return errors.New("empty content")
+	}
+	for _, root := range roots(job.Local) {
+		if !evict(logger, root, max(0, size)) {
+			return errors.New("not enough disk space")
+		}
+	}
+	version := strings.Join([]string{strconv.FormatInt(size, 10), request.ETag, request.Modified}, " ")
+	exists := file.IsRegular(target) != nil
+	handle, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := lock(handle, target); err != nil {
+		return err
+	}
+	lines := file.Read(state)
+	resumed := !streamed && exists && len(lines) != 0 && lines[0] == version && request.ETag+request.Modified != ""
+	if !resumed {
+		if err := handle.Truncate(0); err != nil {
+			return err
+		}
+		os.Remove(state)
+	}
+
+	// readers are served the already downloaded parts (origins ignoring ranges only being tracked if the size is known)
+	var writer io.WriterAt = handle
+	progress := (*Progress)(nil)
+	if size > 0 {
+		if progress = track(job.Local, handle, size, request.ETag, request.Modified); progress == nil {
+			return errors.New("progress tracking failed")
+		}
+		if resumed {
+			progress.load(lines[1:])
+		}
+		writer = progress
+	}
+	writer = shape(job, writer)
+	logger.Info(map[string]any{"scope": "cache", "event": "start", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
+		"size": size, "resumed": resumed})
+
+	start, received, reason, discard := time.Now(), int64(0), "", streamed
+	if streamed {
+		release := acquire(job, job.Remote)
+		if body, total, err := b.Stream(request); err == nil {
+			received, _ = io.Copy(io.NewOffsetWriter(writer, 0), body)
+			body.Close()
+			if size = total; size < 0 {
+				size = received
+			}
+		}
+		release()
+		if received != size {
+			reason = "received " + strconv.FormatInt(received, 10)
+		}
+
+	} else {
+		clients, done, changed, waiter := max(1, min(int64(job.Concurrency), size/config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20))), make(chan struct{}),
+			atomic.Bool{}, make(chan bool, 1)
 		go func() {
 			for {
-				job := <-jobs
-				job.Trigger, job.Remote, job.Local = strings.TrimSpace(job.Trigger), strings.TrimSpace(job.Remote), strings.TrimSpace(job.Local)
-				if job.Trigger == "" || job.Local == "" || job.Remote == "" {
-					continue
-				}
+				select {
+				case <-time.After(5 * time.Second):
+					progress.save(state, version)
 
-				root := filepath.Dir(job.Local)
-				target := filepath.Join(root, "_"+filepath.Base(job.Local))
-				if info, err := os.Stat(target); err == nil {
-					if time.Since(info.ModTime()) < 5*time.Minute {
-						continue
-					}
-					os.Remove(target)
-				}
-				if job.Delay != 0 {
-					time.Sleep(job.Delay + (job.Delay / 10) - time.Duration(rand.Int63n(int64(job.Delay/5))))
-				}
-				if _, err := os.Stat(target); err == nil {
-					continue
-				}
-				if err := os.MkdirAll(root, 0o755); err != nil {
-					continue
-				}
-				size, _, err := b.HTTP(job.Remote, 0, 1, 10, nil)
-				if err != nil {
-					continue
-				}
-				handle, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
-				if err != nil {
-					continue
+				case <-done:
+					return
 				}
-				if size == 0 {
-					handle.Close()
-					continue
-				}
-				logger.Info(map[string]any{"scope": "cache", "event": "start", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local, "size": size})
+			}
+		}()
+		for client := int64(0); client < clients; client++ {
+			begin, length := (size/clients)*client, size/clients
+			if size-(begin+length) < size/clients {
+				length = size - begin
+			}
 
-				start, received, clients, waiter := time.Now(), int64(0), max(1, min(int64(job.Concurrency), size/config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20))), make(chan int64, 1)
-				for client := int64(0); client < clients; client++ {
-					begin, length := (size/clients)*client, size/clients
-					if size-(begin+length) < size/clients {
-						length = size - begin
+			// all ranges are fetched against the content version seen by the probe, missing parts only
+			go func(request b.Request, begin, end int64) {
+				request.Timeout = 3600
+				for attempt := 0; attempt < 6 && !changed.Load(); attempt++ {
+					if attempt != 0 {
+						time.Sleep(min(time.Minute, time.Second<<(attempt-1)))
 					}
-
-					go func(begin, length int64) {
-						received, _, err := b.HTTP(job.Remote, begin, length, 3600, job.Headers, handle)
+					gaps := progress.gaps(begin, end)
+					for _, gap := range gaps {
+						release := acquire(job, job.Remote)
+						_, _, err := b.HTTP(&request, gap[0], gap[1]-gap[0], writer)
+						release()
 						if err != nil {
-							waiter <- 0
-							return
+							if errors.Is(err, b.ErrChanged) {
+								changed.Store(true)
+							}
+							break
 						}
-						waiter <- received
-					}(begin, length)
-				}
-				for clients > 0 {
-					received += <-waiter
-					clients--
-				}
-				close(waiter)
-				handle.Close()
-
-				if received != size {
-					logger.Warn(map[string]any{"scope": "cache", "event": "end", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
-						"size": size, "reason": "received " + strconv.FormatInt(received, 10)})
-					os.Remove(target)
-
-				} else {
-					os.Rename(target, job.Local)
-					if job.Refresh != 0 {
-						file.Write(filepath.Join(root, "."+filepath.Base(job.Local)+".refresh"), []string{strconv.Itoa(job.Refresh)})
 					}
-					duration := time.Since(start)
-					logger.Info(map[string]any{"scope": "cache", "event": "end", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
-						"size": size, "duration": ustr.Duration(duration), "bandwidth": ustr.Bandwidth(int64(float64(size*8) / (float64(duration) / float64(time.Second))))})
+					if len(progress.gaps(begin, end)) == 0 {
+						break
+					}
 				}
-			}
-		}()
+				waiter <- true
+			}(*request, begin, begin+length)
+		}
+		for ; clients > 0; clients-- {
+			<-waiter
+		}
+		close(done)
+		if received = progress.Written(); received != size {
+			reason = "received " + strconv.FormatInt(received, 10)
+		}
+		if changed.Load() {
+			reason, discard = b.ErrChanged.Error(), true
+		}
+	}
+
+	// complete downloads are checked against the origin published checksum (if any) before being renamed into place
+	digest := ""
+	if reason == "" {
+		digest = hash(target)
+		if sum, err := expected(job, request); err != nil {
+			reason = "checksum unavailable (" + err.Error() + ")"
+
+		} else if sum != "" && "sha256:"+sum != digest {
+			reason, discard = ErrMismatch.Error(), true
+			logger.Warn(map[string]any{"scope": "cache", "event": "quarantine", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
+				"expected": "sha256:" + sum, "received": digest, "path": quarantine(job.Local, target)})
+		}
+	}
+	if reason != "" {
+		logger.Warn(map[string]any{"scope": "cache", "event": "end", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
+			"size": size, "reason": reason})
+		if discard {
+			os.Remove(target)
+			os.Remove(state)
+
+		} else {
+			progress.save(state, version)
+		}
+		if progress != nil {
+			progress.finish(job.Local, true)
+		}
+		return errors.New(reason)
 	}
+	duration := time.Since(start)
+	os.Rename(target, job.Local)
+	os.Remove(state)
+	if progress != nil {
+		progress.finish(job.Local, false)
+	}
+	describe(job.Local, func(metadata *Metadata) {
+		now := time.Now()
+		metadata.Remote, metadata.ETag, metadata.Modified, metadata.Size, metadata.Hash = job.Remote, request.ETag, request.Modified, size, digest
+		metadata.Fetched, metadata.Duration, metadata.Refresh, metadata.Validated = now, duration, job.Refresh, now
+	})
+	for _, root := range roots(job.Local) {
+		evict(logger, root, 0)
+	}
+	logger.Info(map[string]any{"scope": "cache", "event": "end", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
+		"size": size, "duration": ustr.Duration(duration), "bandwidth": ustr.Bandwidth(int64(float64(size*8) / (float64(duration) / float64(time.Second))))})
+
+	return nil
 }
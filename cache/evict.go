@@ -0,0 +1,269 @@
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pyke369/golang-support/file"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+// cached files are served through the route resolver, which records their accesses (last time and count) and
+// holds them while they are being served; cache roots are bounded in size, the least recently (or least frequently)
+// served files being evicted first
+type access struct {
+	last  time.Time
+	count int64
+	users int
+	dirty bool
+}
+
+type limit struct {
+	size     int64
+	strategy string
+}
+
+var (
+	accesses = struct {
+		sync.Mutex
+		entries map[string]*access
+	}{entries: map[string]*access{}}
+	limits = struct {
+		sync.Mutex
+		entries map[string]*limit
+		free    int64
+	}{entries: map[string]*limit{}}
+)
+
+// Reset forgets the cache roots limits (before the configuration is loaded again), setting the minimum free space
+func Reset(free int64) {
+	limits.Lock()
+	limits.entries, limits.free = map[string]*limit{}, free
+	limits.Unlock()
+}
+
+// Limit bounds the size of a cache root (0 meaning unbounded, the smallest size being kept when several policies share
+// the same root), all roots being subject to the minimum free space guard
+func Limit(root string, size int64, strategy string) {
+	root = filepath.Clean(root)
+	limits.Lock()
+	if current := limits.entries[root]; current == nil || (size > 0 && (current.size == 0 || size < current.size)) {
+		limits.entries[root] = &limit{size: size, strategy: strategy}
+	}
+	limits.Unlock()
+}
+
+func Use(path string) {
+	if path == "" {
+		return
+	}
+	path = filepath.Clean(path)
+	if len(roots(path)) == 0 {
+		return
+	}
+	accesses.Lock()
+	entry := accesses.entries[path]
+	accesses.Unlock()
+	if entry == nil {
+		entry = &access{}
+		if metadata := Meta(path); metadata != nil {
+			entry.count = metadata.Hits
+		}
+	}
+	accesses.Lock()
+	if current := accesses.entries[path]; current != nil {
+		entry = current
+
+	} else {
+		accesses.entries[path] = entry
+	}
+	entry.last, entry.count, entry.users, entry.dirty = time.Now(), entry.count+1, entry.users+1, true
+	accesses.Unlock()
+}
+
+func Done(path string) {
+	if path == "" {
+		return
+	}
+	path = filepath.Clean(path)
+	accesses.Lock()
+	if entry := accesses.entries[path]; entry != nil && entry.users > 0 {
+		entry.users--
+	}
+	accesses.Unlock()
+}
+
+// flush records the last served time and count of recently served objects in their metadata
+func flush() {
+	served := map[string]access{}
+	accesses.Lock()
+	for path, entry := range accesses.entries {
+		if entry.dirty {
+			served[path], entry.dirty = *entry, false
+		}
+	}
+	accesses.Unlock()
+	for path, entry := range served {
+		if file.IsRegular(path) != nil && file.IsRegular(Sidecar(path)) != nil {
+			describe(path, func(metadata *Metadata) {
+				metadata.Served, metadata.Hits = entry.last, entry.count
+			})
+		}
+	}
+}
+
+func free(path string) int64 {
+	stat := syscall.Statfs_t{}
+	if syscall.Statfs(path, &stat) != nil {
+		return -1
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize)
+}
+
+type candidate struct {
+	path        string
+	size        int64
+	last        time.Time
+	count       int64
+	quarantined bool
+}
+
+// evict brings root under its size limit, keeping room for need more bytes (beyond the minimum free space)
+func evict(logger *ulog.ULog, root string, need int64) bool {
+	limits.Lock()
+	bound, minimum := limits.entries[root], limits.free
+	limits.Unlock()
+
+	candidates, total, quarantined := []*candidate{}, int64(0), filepath.Join(root, ".quarantine")+string(filepath.Separator)
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		// quarantined copies are accounted for too, and evicted before any cached object
+		if strings.HasPrefix(path, quarantined) {
+			total += info.Size()
+			candidates = append(candidates, &candidate{path: path, size: info.Size(), last: info.ModTime(), quarantined: true})
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), "_") || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+
+		// only objects created by the cache (described by a sidecar) are accounted for and evicted, other files (hand
+		// placed in a root shared with a file backend) being left alone
+		item, metadata := &candidate{path: filepath.Clean(path), size: info.Size(), last: info.ModTime()}, Meta(path)
+		if metadata == nil {
+			return nil
+		}
+		if !metadata.Served.IsZero() {
+			item.last, item.count = metadata.Served, metadata.Hits
+		}
+		accesses.Lock()
+		if entry := accesses.entries[item.path]; entry != nil {
+			if entry.users > 0 {
+				item = nil
+
+			} else {
+				item.last, item.count = entry.last, entry.count
+			}
+		}
+		accesses.Unlock()
+		total += info.Size()
+		if item != nil {
+			candidates = append(candidates, item)
+		}
+		return nil
+	})
+
+	excess := int64(0)
+	if bound != nil && bound.size > 0 {
+		excess = total + need - bound.size
+	}
+	if available := free(root); available >= 0 && minimum > 0 {
+		excess = max(excess, minimum+need-available)
+	}
+	if excess <= 0 {
+		return true
+	}
+	slices.SortFunc(candidates, func(a, b *candidate) int {
+		if a.quarantined != b.quarantined {
+			if a.quarantined {
+				return -1
+			}
+			return 1
+		}
+		if bound != nil && bound.strategy == "lfu" && a.count != b.count {
+			if a.count < b.count {
+				return -1
+			}
+			return 1
+		}
+		return a.last.Compare(b.last)
+	})
+	for _, item := range candidates {
+		if excess <= 0 {
+			break
+		}
+		if item.quarantined {
+			if os.Remove(item.path) == nil {
+				excess -= item.size
+				logger.Info(map[string]any{"scope": "cache", "event": "evict", "path": item.path, "size": item.size})
+			}
+			continue
+		}
+		if Purge(item.path) == nil {
+			excess -= item.size
+			logger.Info(map[string]any{"scope": "cache", "event": "evict", "local": item.path, "size": item.size})
+		}
+	}
+
+	return excess <= 0
+}
+
+// Purge removes a cached object along with its metadata
+func Purge(local string) error {
+	local = filepath.Clean(local)
+	if err := os.Remove(local); err != nil {
+		return err
+	}
+	undescribe(local)
+	accesses.Lock()
+	delete(accesses.entries, local)
+	accesses.Unlock()
+
+	return nil
+}
+
+// Roots returns the cache roots (the static part of the cache policies paths)
+func Roots() []string {
+	out := roots("")
+	slices.Sort(out)
+
+	return out
+}
+
+// roots returns the bounded cache roots containing path (all of them if path is empty)
+func roots(path string) (out []string) {
+	path = filepath.Clean(path)
+	limits.Lock()
+	for root := range limits.entries {
+		if path == "." || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			out = append(out, root)
+		}
+	}
+	limits.Unlock()
+
+	return out
+}
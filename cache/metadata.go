@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pyke369/golang-support/file"
+)
+
+// each cached object is described by a hidden JSON sidecar next to it (.name.meta), recording where and when it was
+// fetched from, its validators and content hash, its refresh policy and when it was last served
+type Metadata struct {
+	Remote    string        `json:"remote"`
+	ETag      string        `json:"etag,omitempty"`
+	Modified  string        `json:"modified,omitempty"`
+	Size      int64         `json:"size"`
+	Hash      string        `json:"hash,omitempty"`
+	Fetched   time.Time     `json:"fetched,omitzero"`
+	Duration  time.Duration `json:"duration,omitempty"`
+	Refresh   int           `json:"refresh,omitempty"`
+	Validated time.Time     `json:"validated,omitzero"`
+	Served    time.Time     `json:"served,omitzero"`
+	Hits      int64         `json:"hits,omitempty"`
+}
+
+var sidecars sync.Mutex
+
+func Sidecar(local string) string {
+	return filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+".meta")
+}
+
+// Meta returns the metadata of the cached object local, nil if there are none (objects cached by previous versions
+// only having their refresh delay recorded)
+func Meta(local string) *Metadata {
+	metadata := &Metadata{}
+	if content, err := os.ReadFile(Sidecar(local)); err == nil {
+		if json.Unmarshal(content, metadata) == nil {
+			return metadata
+		}
+		return nil
+	}
+	if lines := file.Read(filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+".refresh")); len(lines) != 0 {
+		if refresh, err := strconv.Atoi(lines[0]); err == nil {
+			metadata.Refresh = refresh
+			if info := file.IsRegular(local); info != nil {
+				metadata.Size, metadata.Fetched = info.Size(), info.ModTime()
+			}
+			return metadata
+		}
+	}
+
+	return nil
+}
+
+// describe updates (or creates) the metadata of local, the sidecar being replaced atomically
+func describe(local string, update func(metadata *Metadata)) {
+	sidecars.Lock()
+	defer sidecars.Unlock()
+	metadata := Meta(local)
+	if metadata == nil {
+		metadata = &Metadata{}
+	}
+	update(metadata)
+	if content, err := json.Marshal(metadata); err == nil {
+		path := Sidecar(local)
+		if os.WriteFile(path+".tmp", content, 0o644) == nil && os.Rename(path+".tmp", path) == nil {
+			os.Remove(filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+".refresh"))
+		}
+	}
+}
+
+func undescribe(local string) {
+	os.Remove(Sidecar(local))
+	os.Remove(filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+".refresh"))
+}
+
+func hash(path string) string {
+	handle, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer handle.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, handle); err != nil {
+		return ""
+	}
+
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Expired tells whether the cached object local has outlived its refresh delay, counted from its last validation
+// against the origin
+func Expired(local string) bool {
+	metadata := Meta(local)
+	if metadata == nil || metadata.Refresh <= 0 {
+		return false
+	}
+	validated := metadata.Validated
+	if validated.IsZero() {
+		validated = metadata.Fetched
+	}
+
+	return !validated.IsZero() && time.Since(validated) >= time.Duration(metadata.Refresh)*time.Second
+}
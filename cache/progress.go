@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyke369/golang-support/file"
+)
+
+// Progress tracks the ranges already written by a running download, readers being served from the temporary file
+// as soon as (and only if) the parts they need are there
+type Progress struct {
+	sync.Mutex
+	cond     *sync.Cond
+	handle   *os.File
+	writer   *os.File
+	size     int64
+	etag     string
+	modified string
+	ranges   [][2]int64
+	done     bool
+	failed   bool
+	readers  int
+}
+
+var (
+	ErrNotReady = errors.New("range not downloaded yet")
+	progresses  = struct {
+		sync.Mutex
+		entries map[string]*Progress
+	}{entries: map[string]*Progress{}}
+)
+
+func track(local string, writer *os.File, size int64, etag, modified string) *Progress {
+	handle, err := os.Open(writer.Name())
+	if err != nil {
+		return nil
+	}
+	progress := &Progress{handle: handle, writer: writer, size: size, etag: etag, modified: modified}
+	progress.cond = sync.NewCond(progress)
+	progresses.Lock()
+	progresses.entries[local] = progress
+	progresses.Unlock()
+
+	return progress
+}
+
+// Lookup returns the progress of the running download of local (to be released after use), nil if there is none
+func Lookup(local string) *Progress {
+	progresses.Lock()
+	defer progresses.Unlock()
+	if progress := progresses.entries[local]; progress != nil {
+		progress.Lock()
+		progress.readers++
+		progress.Unlock()
+		return progress
+	}
+
+	return nil
+}
+
+func (p *Progress) Release() {
+	p.Lock()
+	defer p.Unlock()
+	if p.readers--; p.readers == 0 && p.done {
+		p.handle.Close()
+	}
+}
+
+func (p *Progress) Size() int64 {
+	return p.size
+}
+
+// Version returns the validators of the remote content version being downloaded
+func (p *Progress) Version() (etag, modified string) {
+	return p.etag, p.modified
+}
+
+func (p *Progress) WriteAt(content []byte, offset int64) (written int, err error) {
+	written, err = p.writer.WriteAt(content, offset)
+	if written > 0 {
+		p.Lock()
+		p.ranges = append(p.ranges, [2]int64{offset, offset + int64(written)})
+		p.merge()
+		p.cond.Broadcast()
+		p.Unlock()
+	}
+
+	return written, err
+}
+
+// progress is persisted as the remote content version followed by the written ranges
+func (p *Progress) load(lines []string) {
+	p.Lock()
+	defer p.Unlock()
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			begin, err1 := strconv.ParseInt(fields[0], 10, 64)
+			end, err2 := strconv.ParseInt(fields[1], 10, 64)
+			if err1 == nil && err2 == nil && begin >= 0 && begin < end && end <= p.size {
+				p.ranges = append(p.ranges, [2]int64{begin, end})
+			}
+		}
+	}
+	p.merge()
+}
+
+func (p *Progress) save(path, version string) {
+	p.Lock()
+	lines := []string{version}
+	for _, current := range p.ranges {
+		lines = append(lines, strconv.FormatInt(current[0], 10)+" "+strconv.FormatInt(current[1], 10))
+	}
+	p.Unlock()
+	file.Write(path, lines, "create")
+}
+
+func (p *Progress) Written() (written int64) {
+	p.Lock()
+	defer p.Unlock()
+	for _, current := range p.ranges {
+		written += current[1] - current[0]
+	}
+
+	return written
+}
+
+// gaps returns the ranges still missing between begin and end
+func (p *Progress) gaps(begin, end int64) (gaps [][2]int64) {
+	p.Lock()
+	defer p.Unlock()
+	for _, current := range p.ranges {
+		if current[1] <= begin || current[0] >= end {
+			continue
+		}
+		if current[0] > begin {
+			gaps = append(gaps, [2]int64{begin, current[0]})
+		}
+		begin = max(begin, current[1])
+	}
+	if begin < end {
+		gaps = append(gaps, [2]int64{begin, end})
+	}
+
+	return gaps
+}
+
+func (p *Progress) finish(local string, failed bool) {
+	progresses.Lock()
+	delete(progresses.entries, local)
+	progresses.Unlock()
+	p.Lock()
+	p.done, p.failed = true, failed
+	if p.readers == 0 {
+		p.handle.Close()
+	}
+	p.cond.Broadcast()
+	p.Unlock()
+}
+
+func (p *Progress) merge() {
+	if len(p.ranges) == 0 {
+		return
+	}
+	sort.Slice(p.ranges, func(i, j int) bool { return p.ranges[i][0] < p.ranges[j][0] })
+	merged := p.ranges[:1]
+	for _, current := range p.ranges[1:] {
+		if last := &merged[len(merged)-1]; current[0] <= last[1] {
+			last[1] = max(last[1], current[1])
+
+		} else {
+			merged = append(merged, current)
+		}
+	}
+	p.ranges = merged
+}
+
+func (p *Progress) covered(begin, end int64) bool {
+	for _, current := range p.ranges {
+		if current[0] <= begin && current[1] >= end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadAt waits (at most for wait, whatever the progress of other ranges) for the requested range to be downloaded,
+// ErrNotReady telling the caller to get it from elsewhere (the download having failed or being too slow)
+func (p *Progress) ReadAt(content []byte, offset int64, wait time.Duration) (read int, err error) {
+	if offset >= p.size {
+		return 0, io.EOF
+	}
+	end, expired := min(offset+int64(len(content)), p.size), false
+	timer := time.AfterFunc(wait, func() {
+		p.Lock()
+		expired = true
+		p.cond.Broadcast()
+		p.Unlock()
+	})
+	defer timer.Stop()
+
+	p.Lock()
+	for !p.covered(offset, end) && !p.failed && !expired {
+		p.cond.Wait()
+	}
+	ready := p.covered(offset, end)
+	p.Unlock()
+	if !ready {
+		return 0, ErrNotReady
+	}
+	if read, err = p.handle.ReadAt(content[:end-offset], offset); err == nil && read < len(content) {
+		err = io.EOF
+	}
+
+	return read, err
+}
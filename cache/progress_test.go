@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges [][2]int64
+		merged [][2]int64
+	}{
+		{"empty", nil, nil},
+		{"single", [][2]int64{{0, 10}}, [][2]int64{{0, 10}}},
+		{"disjoint", [][2]int64{{20, 30}, {0, 10}}, [][2]int64{{0, 10}, {20, 30}}},
+		{"adjacent", [][2]int64{{10, 20}, {0, 10}}, [][2]int64{{0, 20}}},
+		{"overlapping", [][2]int64{{0, 15}, {10, 20}}, [][2]int64{{0, 20}}},
+		{"contained", [][2]int64{{0, 30}, {10, 20}}, [][2]int64{{0, 30}}},
+		{"mixed", [][2]int64{{40, 50}, {0, 10}, {5, 12}, {30, 40}, {60, 70}}, [][2]int64{{0, 12}, {30, 50}, {60, 70}}},
+	}
+	for _, test := range tests {
+		progress := &Progress{ranges: slices.Clone(test.ranges)}
+		if progress.merge(); !slices.Equal(progress.ranges, test.merged) {
+			t.Errorf("%s: merge() = %v, want %v", test.name, progress.ranges, test.merged)
+		}
+	}
+}
+
+func TestGaps(t *testing.T) {
+	ranges := [][2]int64{{10, 20}, {30, 40}}
+	tests := []struct {
+		begin int64
+		end   int64
+		gaps  [][2]int64
+	}{
+		{0, 50, [][2]int64{{0, 10}, {20, 30}, {40, 50}}},
+		{10, 20, nil},
+		{12, 18, nil},
+		{10, 40, [][2]int64{{20, 30}}},
+		{0, 10, [][2]int64{{0, 10}}},
+		{15, 35, [][2]int64{{20, 30}}},
+		{40, 50, [][2]int64{{40, 50}}},
+		{45, 50, [][2]int64{{45, 50}}},
+		{5, 15, [][2]int64{{5, 10}}},
+	}
+	for _, test := range tests {
+		progress := &Progress{ranges: slices.Clone(ranges)}
+		if gaps := progress.gaps(test.begin, test.end); !slices.Equal(gaps, test.gaps) {
+			t.Errorf("gaps(%d, %d) = %v, want %v", test.begin, test.end, gaps, test.gaps)
+		}
+	}
+	if gaps := (&Progress{}).gaps(0, 10); !slices.Equal(gaps, [][2]int64{{0, 10}}) {
+		t.Errorf("gaps(0, 10) without ranges = %v", gaps)
+	}
+}
+
+func TestReadAtWait(t *testing.T) {
+	writer, err := os.Create(filepath.Join(t.TempDir(), "_object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	progress := track("object", writer, 1024, "", "")
+	defer progress.finish("object", false)
+
+	// writes to other ranges do not extend the wait for the requested one
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for offset := int64(512); ; offset = 512 + (offset+1)%512 {
+			select {
+			case <-stop:
+				return
+
+			case <-time.After(10 * time.Millisecond):
+				progress.WriteAt([]byte{1}, offset)
+			}
+		}
+	}()
+	start, content := time.Now(), make([]byte, 16)
+	if _, err := progress.ReadAt(content, 0, 200*time.Millisecond); !errors.Is(err, ErrNotReady) {
+		t.Errorf("ReadAt() error = %v, want %v", err, ErrNotReady)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadAt() waited %v", elapsed)
+	}
+
+	progress.WriteAt(make([]byte, 16), 0)
+	if read, err := progress.ReadAt(content, 0, 200*time.Millisecond); err != nil || read != len(content) {
+		t.Errorf("ReadAt() = %d, %v, want %d, nil", read, err, len(content))
+	}
+}
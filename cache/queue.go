@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyke369/golang-support/uconfig"
+	"github.com/pyke369/golang-support/ulog"
+	"github.com/pyke369/golang-support/ustr"
+)
+
+// jobs are deduplicated by local path and served in order by the workers (jobs restricted to prefetch windows waiting
+// for one to open), the state of all known jobs (pending, running or recently failed) being persisted so pending ones
+// survive a restart; failed jobs are not queued again before a cooldown doubling with each consecutive failure
+const (
+	StatePending = "pending"
+	StateRunning = "running"
+	StateFailed  = "failed"
+)
+
+type State struct {
+	Job      *Job      `json:"job"`
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	Failures int       `json:"failures,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+var manager = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	logger  *ulog.ULog
+	states  map[string]*State
+	pending []string
+	limit   int
+	path    string
+	dirty   bool
+}{states: map[string]*State{}}
+
+// Retry returns when a failed job may be queued again
+func (s *State) Retry() time.Time {
+	if s.State != StateFailed {
+		return s.Updated
+	}
+
+	return s.Updated.Add(min(time.Hour, time.Minute<<min(max(s.Failures, 1)-1, 6)))
+}
+
+func Queue(job *Job) {
+	job.Trigger, job.Remote, job.Local = strings.TrimSpace(job.Trigger), strings.TrimSpace(job.Remote), strings.TrimSpace(job.Local)
+	manager.Lock()
+	defer manager.Unlock()
+	if manager.cond == nil {
+		return
+	}
+	if job.Trigger == "" || job.Local == "" || job.Remote == "" {
+		manager.logger.Warn(map[string]any{"scope": "cache", "event": "reject", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
+			"reason": "invalid job"})
+		return
+	}
+	failures := 0
+	if state := manager.states[job.Local]; state != nil && state.State == StateFailed {
+		if time.Now().Before(state.Retry()) {
+			return
+		}
+		failures = state.Failures
+
+	} else if state != nil {
+		// a pending job waiting for a prefetch window is started right away if a client needs the same file
+		if state.State == StatePending && len(state.Job.Windows) != 0 && len(job.Windows) == 0 {
+			state.Job, state.Updated, manager.dirty = job, time.Now(), true
+			manager.cond.Signal()
+		}
+		return
+	}
+	if len(manager.pending) >= manager.limit {
+		manager.logger.Warn(map[string]any{"scope": "cache", "event": "reject", "trigger": job.Trigger, "remote": job.Remote, "local": job.Local,
+			"reason": "queue full"})
+		return
+	}
+	manager.states[job.Local] = &State{Job: job, State: StatePending, Failures: failures, Updated: time.Now()}
+	manager.pending, manager.dirty = append(manager.pending, job.Local), true
+	manager.cond.Signal()
+}
+
+// Jobs returns a snapshot of the known jobs states, ordered by local path
+func Jobs() (states []State) {
+	manager.Lock()
+	for _, state := range manager.states {
+		states = append(states, *state)
+	}
+	manager.Unlock()
+	slices.SortFunc(states, func(a, b State) int { return strings.Compare(a.Job.Local, b.Job.Local) })
+
+	return states
+}
+
+// LoadJobs reads jobs states persisted in path
+func LoadJobs(path string) (states []*State) {
+	if content, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(content, &states)
+	}
+
+	return slices.DeleteFunc(states, func(state *State) bool { return state == nil || state.Job == nil })
+}
+
+func persist() {
+	manager.Lock()
+	for local, state := range manager.states {
+		if state.State == StateFailed && time.Since(state.Updated) >= 24*time.Hour {
+			delete(manager.states, local)
+			manager.dirty = true
+		}
+	}
+	if !manager.dirty || manager.path == "" {
+		manager.Unlock()
+		return
+	}
+	states := []*State{}
+	for _, state := range manager.states {
+		copied := *state
+		states = append(states, &copied)
+	}
+	manager.dirty = false
+	manager.Unlock()
+
+	// jobs headers (possibly carrying credentials) are persisted, the file is only readable by its owner
+	slices.SortFunc(states, func(a, b *State) int { return a.Updated.Compare(b.Updated) })
+	if content, err := json.Marshal(states); err == nil {
+		if os.MkdirAll(filepath.Dir(manager.path), 0o755) == nil && os.WriteFile(manager.path+".tmp", content, 0o600) == nil {
+			os.Rename(manager.path+".tmp", manager.path)
+		}
+	}
+}
+
+func Run(config *uconfig.UConfig, logger *ulog.ULog) {
+	workers := int(config.IntegerBounds("cache_workers", 32, 1, 32))
+	manager.Lock()
+	manager.cond, manager.logger = sync.NewCond(&manager), logger
+	manager.limit, manager.path = int(config.IntegerBounds("cache_queue", 4096, 16, 1<<20)), strings.TrimSpace(config.String("cache_state"))
+	manager.Unlock()
+	Configure(config)
+
+	// pending (and interrupted) jobs are queued again, failed ones being kept for reference
+	if manager.path != "" {
+		states := LoadJobs(manager.path)
+		for _, state := range states {
+			if state.State == StateFailed {
+				manager.Lock()
+				manager.states[state.Job.Local] = state
+				manager.Unlock()
+				continue
+			}
+			state.Job.Delay = 0
+			Queue(state.Job)
+		}
+		if len(states) != 0 {
+			logger.Info(map[string]any{"scope": "cache", "event": "restore", "path": manager.path, "jobs": len(states)})
+		}
+	}
+	go func() {
+		for range time.Tick(time.Second) {
+			persist()
+		}
+	}()
+	go func() {
+		last := time.Now()
+		for range time.Tick(time.Minute) {
+			now, pending, deferred, running, failed := time.Now(), 0, 0, 0, 0
+			for _, state := range Jobs() {
+				switch state.State {
+				case StateRunning:
+					running++
+
+				case StateFailed:
+					failed++
+				}
+			}
+			manager.Lock()
+			manager.cond.Broadcast()
+			for _, local := range manager.pending {
+				if opened(manager.states[local].Job.Windows, now) {
+					pending++
+
+				} else {
+					deferred++
+				}
+			}
+			manager.Unlock()
+			hosts, waiting := usage()
+			if amount := volume.Swap(0); amount != 0 || pending+deferred+running != 0 {
+				logger.Info(map[string]any{"scope": "cache", "event": "stats", "pending": pending, "deferred": deferred, "running": running,
+					"failed": failed, "connections": hosts, "waiting": waiting, "bandwidth": ustr.Bandwidth(int64(float64(amount*8) / now.Sub(last).Seconds()))})
+			}
+			last = now
+			flush()
+			for _, root := range roots("") {
+				evict(logger, root, 0)
+			}
+		}
+	}()
+
+	for index := 1; index <= workers; index++ {
+		go func() {
+			for {
+				manager.Lock()
+				index := -1
+				for {
+					now := time.Now()
+					if index = slices.IndexFunc(manager.pending, func(local string) bool {
+						return opened(manager.states[local].Job.Windows, now)
+					}); index >= 0 {
+						break
+					}
+					manager.cond.Wait()
+				}
+				state := manager.states[manager.pending[index]]
+				manager.pending = slices.Delete(manager.pending, index, index+1)
+				state.State, state.Updated, manager.dirty = StateRunning, time.Now(), true
+				manager.Unlock()
+
+				err := Download(config, logger, state.Job)
+				manager.Lock()
+				if err != nil {
+					state.State, state.Reason, state.Failures, state.Updated = StateFailed, err.Error(), state.Failures+1, time.Now()
+					logger.Warn(map[string]any{"scope": "cache", "event": "failed", "trigger": state.Job.Trigger, "remote": state.Job.Remote,
+						"local": state.Job.Local, "reason": state.Reason, "failures": state.Failures, "retry": state.Retry().Format(time.DateTime)})
+
+				} else {
+					delete(manager.states, state.Job.Local)
+				}
+				manager.dirty = true
+				manager.Unlock()
+			}
+		}()
+	}
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pyke369/golang-support/uconfig"
+)
+
+// cache downloads are shaped by token buckets (one shared by all downloads, one per cache policy), writes being held
+// until enough tokens are available, and limited in concurrent connections per origin host (globally and per cache
+// policy); the received volume is accounted for the periodic throughput report
+type bucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+type slots struct {
+	sync.Mutex
+	cond    *sync.Cond
+	used    map[string]int
+	waiting int
+}
+
+type shaped struct {
+	writer  io.WriterAt
+	reader  io.Reader
+	buckets []*bucket
+}
+
+var (
+	shaping = struct {
+		sync.Mutex
+		global      *bucket
+		policies    map[string]*bucket
+		connections int
+	}{policies: map[string]*bucket{}}
+	connections = &slots{used: map[string]int{}}
+	volume      atomic.Int64
+)
+
+func init() {
+	connections.cond = sync.NewCond(connections)
+}
+
+// wait consumes size tokens, sleeping as long as needed for them to be available (bursts being bounded to a second
+// worth of tokens)
+func (b *bucket) wait(size int) {
+	b.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.tokens, b.last = b.tokens-float64(size), now
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (s *shaped) WriteAt(content []byte, offset int64) (written int, err error) {
+	for _, bucket := range s.buckets {
+		bucket.wait(len(content))
+	}
+	written, err = s.writer.WriteAt(content, offset)
+	volume.Add(int64(written))
+
+	return written, err
+}
+
+func (s *shaped) Read(content []byte) (read int, err error) {
+	read, err = s.reader.Read(content)
+	for _, bucket := range s.buckets {
+		bucket.wait(read)
+	}
+	volume.Add(int64(read))
+
+	return read, err
+}
+
+// buckets returns the token buckets a job transfers are shaped by
+func buckets(job *Job) (out []*bucket) {
+	shaping.Lock()
+	defer shaping.Unlock()
+	if shaping.global != nil {
+		out = append(out, shaping.global)
+	}
+	if job.Bandwidth > 0 && job.Policy != "" {
+		policy := shaping.policies[job.Policy]
+		if policy == nil {
+			policy = &bucket{last: time.Now()}
+			shaping.policies[job.Policy] = policy
+		}
+		policy.Lock()
+		policy.rate = float64(job.Bandwidth)
+		policy.Unlock()
+		out = append(out, policy)
+	}
+
+	return out
+}
+
+func shape(job *Job, writer io.WriterAt) io.WriterAt {
+	return &shaped{writer: writer, buckets: buckets(job)}
+}
+
+func shapeReader(job *Job, reader io.Reader) io.Reader {
+	return &shaped{reader: reader, buckets: buckets(job)}
+}
+
+// Configure applies the global cache downloads limits (for both the server workers and the command line)
+func Configure(config *uconfig.UConfig) {
+	rate := config.SizeBounds("cache_bandwidth", 0, 0, 100<<30)
+	shaping.Lock()
+	shaping.global, shaping.connections = nil, int(config.IntegerBounds("cache_connections", 0, 0, 4096))
+	if rate > 0 {
+		shaping.global = &bucket{rate: float64(rate), last: time.Now()}
+	}
+	shaping.Unlock()
+}
+
+func origin(target string) string {
+	if value, err := url.Parse(target); err == nil {
+		return value.Host
+	}
+
+	return target
+}
+
+// acquire waits for a connection slot to the origin host of target (on behalf of job), returning the function
+// releasing it
+func acquire(job *Job, target string) func() {
+	shaping.Lock()
+	global := shaping.connections
+	shaping.Unlock()
+	host := origin(target)
+	keys := []string{host}
+	if job.Connections > 0 && job.Policy != "" {
+		keys = append(keys, job.Policy+"|"+host)
+	}
+
+	connections.Lock()
+	for (global > 0 && connections.used[keys[0]] >= global) || (len(keys) > 1 && connections.used[keys[1]] >= job.Connections) {
+		connections.waiting++
+		connections.cond.Wait()
+		connections.waiting--
+	}
+	for _, key := range keys {
+		connections.used[key]++
+	}
+	connections.Unlock()
+
+	return func() {
+		connections.Lock()
+		for _, key := range keys {
+			if connections.used[key]--; connections.used[key] <= 0 {
+				delete(connections.used, key)
+			}
+		}
+		connections.cond.Broadcast()
+		connections.Unlock()
+	}
+}
+
+// usage returns the connections currently opened per origin host and the number of downloaders waiting for one
+func usage() (hosts map[string]int, waiting int) {
+	hosts = map[string]int{}
+	connections.Lock()
+	for key, count := range connections.used {
+		if !strings.Contains(key, "|") {
+			hosts[key] = count
+		}
+	}
+	waiting = connections.waiting
+	connections.Unlock()
+
+	return hosts, waiting
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pyke369/golang-support/rcache"
+
+	b "ptftp/backend"
+)
+
+// downloads may be verified against a SHA-256 checksum published by the origin, either in a per-file sidecar
+// (${1}.sha256), in a SHA256SUMS manifest (GNU or BSD format) or in a digest response header (Repr-Digest, Digest or
+// a plain hexadecimal value); mismatching contents are moved to a quarantine directory instead of being served
+type Checksum struct {
+	URL      string
+	Manifest string
+	Header   string
+}
+
+var ErrMismatch = errors.New("checksum mismatch")
+
+func text(job *Job, target string) ([]string, error) {
+	release := acquire(job, target)
+	defer release()
+	body, _, err := b.Stream(&b.Request{Target: target, Headers: job.Headers, Timeout: 10, Transport: job.Transport})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	lines, scanner := []string{}, bufio.NewScanner(shapeReader(job, io.LimitReader(body, 4<<20)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+func digest(value string) string {
+	if value = strings.ToLower(strings.TrimSpace(value)); len(value) == 64 {
+		if _, err := hex.DecodeString(value); err == nil {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// expected returns the checksum the downloaded content must match (empty if the job has no checksum source), request
+// carrying the validators of the downloaded content version
+func expected(job *Job, request *b.Request) (string, error) {
+	name := job.Remote
+	if index := strings.IndexAny(name, "?#"); index >= 0 {
+		name = name[:index]
+	}
+	name = path.Base(name)
+
+	switch {
+	case job.Checksum == nil:
+		return "", nil
+
+	case job.Checksum.URL != "":
+		lines, err := text(job, job.Checksum.URL)
+		if err != nil {
+			return "", err
+		}
+		if len(lines) != 0 {
+			if value := digest(strings.Fields(lines[0])[0]); value != "" {
+				return value, nil
+			}
+		}
+
+	case job.Checksum.Manifest != "":
+		lines, err := text(job, job.Checksum.Manifest)
+		if err != nil {
+			return "", err
+		}
+		for _, line := range lines {
+			if captures := rcache.Get(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`).FindStringSubmatch(line); captures != nil {
+				if path.Base(captures[1]) == name {
+					return digest(captures[2]), nil
+				}
+				continue
+			}
+			if fields := strings.Fields(line); len(fields) >= 2 && path.Base(strings.TrimPrefix(strings.Join(fields[1:], " "), "*")) == name {
+				if value := digest(fields[0]); value != "" {
+					return value, nil
+				}
+			}
+		}
+		return "", errors.New("no checksum for " + name + " in manifest")
+
+	case job.Checksum.Header != "":
+		copied := *request
+		copied.Timeout = 10
+		release := acquire(job, job.Remote)
+		value, err := b.Header(&copied, job.Checksum.Header)
+		release()
+		if err != nil {
+			return "", err
+		}
+		for _, part := range strings.Split(value, ",") {
+			algorithm, encoded, found := strings.Cut(strings.TrimSpace(part), "=")
+			if !found {
+				if value := digest(algorithm); value != "" {
+					return value, nil
+				}
+				continue
+			}
+			if strings.EqualFold(algorithm, "sha-256") {
+				if decoded, err := base64.StdEncoding.DecodeString(strings.Trim(encoded, ":")); err == nil && len(decoded) == 32 {
+					return hex.EncodeToString(decoded), nil
+				}
+			}
+		}
+	}
+
+	return "", errors.New("no checksum found")
+}
+
+// quarantine moves a mismatching download aside (in the .quarantine directory of the cache root, mirroring the
+// object path), for inspection; only the last mismatching copy of an object is kept
+func quarantine(local, target string) string {
+	destination := filepath.Join(filepath.Dir(local), ".quarantine", filepath.Base(local))
+	for _, root := range roots(local) {
+		if relative, err := filepath.Rel(root, local); err == nil {
+			destination = filepath.Join(root, ".quarantine", relative)
+		}
+		break
+	}
+	if os.MkdirAll(filepath.Dir(destination), 0o755) != nil || os.Rename(target, destination) != nil {
+		os.Remove(target)
+		return ""
+	}
+
+	return destination
+}
+
+// Verify checks a cached object against the content hash recorded in its metadata
+func Verify(local string) error {
+	metadata := Meta(local)
+	if metadata == nil || metadata.Hash == "" {
+		return errors.New("no recorded checksum")
+	}
+	if value := hash(local); value == "" {
+		return errors.New("unreadable content")
+
+	} else if value != metadata.Hash {
+		return ErrMismatch
+	}
+
+	return nil
+}
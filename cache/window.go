@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prefetch windows are cron-like specifications (minute hour day-of-month month day-of-week, with lists, ranges and
+// steps), a job restricted to windows only being started during a minute matching one of them
+var bounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func field(spec string, low, high, value int) (matched, valid bool) {
+	for _, item := range strings.Split(spec, ",") {
+		item, step := strings.TrimSpace(item), 1
+		if before, after, found := strings.Cut(item, "/"); found {
+			number, err := strconv.Atoi(after)
+			if err != nil || number <= 0 {
+				return false, false
+			}
+			item, step = before, number
+		}
+		begin, end := low, high
+		if item != "*" {
+			first, last, found := strings.Cut(item, "-")
+			number, err := strconv.Atoi(first)
+			if err != nil {
+				return false, false
+			}
+			begin, end = number, number
+			if found {
+				if end, err = strconv.Atoi(last); err != nil {
+					return false, false
+				}
+
+			} else if step != 1 {
+				end = high
+			}
+		}
+		if begin < low || end > high || begin > end {
+			return false, false
+		}
+		if value >= begin && value <= end && (value-begin)%step == 0 {
+			matched = true
+		}
+	}
+
+	return matched, true
+}
+
+func window(spec string, now time.Time) (matched, valid bool) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return false, false
+	}
+	values, results := [5]int{now.Minute(), now.Hour(), now.Day(), int(now.Month()), int(now.Weekday())}, [5]bool{}
+	for index := range fields {
+		if results[index], valid = field(fields[index], bounds[index][0], bounds[index][1], values[index]); !valid {
+			return false, false
+		}
+	}
+	if !results[4] && values[4] == 0 {
+		results[4], _ = field(fields[4], bounds[4][0], bounds[4][1], 7)
+	}
+
+	// as with cron, a day matches either restricted day-of-month or day-of-week field
+	day := results[2] && results[4]
+	if fields[2] != "*" && fields[4] != "*" {
+		day = results[2] || results[4]
+	}
+
+	return results[0] && results[1] && results[3] && day, true
+}
+
+// Window tells whether spec is a valid prefetch window specification
+func Window(spec string) bool {
+	_, valid := window(spec, time.Now())
+
+	return valid
+}
+
+func opened(windows []string, now time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, spec := range windows {
+		if matched, _ := window(spec, now); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestField(t *testing.T) {
+	tests := []struct {
+		spec    string
+		low     int
+		high    int
+		value   int
+		matched bool
+		valid   bool
+	}{
+		{"*", 0, 59, 17, true, true},
+		{"17", 0, 59, 17, true, true},
+		{"18", 0, 59, 17, false, true},
+		{"1,17,30", 0, 59, 17, true, true},
+		{"10-20", 0, 59, 17, true, true},
+		{"10-20", 0, 59, 21, false, true},
+		{"*/15", 0, 59, 30, true, true},
+		{"*/15", 0, 59, 31, false, true},
+		{"10-30/10", 0, 59, 20, true, true},
+		{"10-30/10", 0, 59, 25, false, true},
+		{"5/10", 0, 59, 45, true, true},
+		{"5/10", 0, 59, 40, false, true},
+		{" 3 , 4 ", 0, 23, 4, true, true},
+		{"", 0, 59, 0, false, false},
+		{"x", 0, 59, 0, false, false},
+		{"60", 0, 59, 0, false, false},
+		{"0", 1, 31, 1, false, false},
+		{"20-10", 0, 59, 15, false, false},
+		{"1-x", 0, 59, 1, false, false},
+		{"*/0", 0, 59, 0, false, false},
+		{"*/x", 0, 59, 0, false, false},
+		{"1,x", 0, 59, 1, false, false},
+	}
+	for _, test := range tests {
+		if matched, valid := field(test.spec, test.low, test.high, test.value); matched != test.matched || valid != test.valid {
+			t.Errorf("field(%q, %d, %d, %d) = %v, %v, want %v, %v", test.spec, test.low, test.high, test.value, matched, valid, test.matched, test.valid)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	// 2026-03-01 is a sunday
+	now := time.Date(2026, time.March, 1, 2, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec    string
+		matched bool
+		valid   bool
+	}{
+		{"* * * * *", true, true},
+		{"30 2 * * *", true, true},
+		{"31 2 * * *", false, true},
+		{"* 0-5 * * *", true, true},
+		{"* 22-23 * * *", false, true},
+		{"* * 1 3 *", true, true},
+		{"* * * 4 *", false, true},
+		{"* * * * 0", true, true},
+		{"* * * * 7", true, true},
+		{"* * * * 1-5", false, true},
+		{"* * 15 * 0", true, true},
+		{"* * 1 * 1", true, true},
+		{"* * 15 * 1", false, true},
+		{"* * * *", false, false},
+		{"* * * * * *", false, false},
+		{"* 24 * * *", false, false},
+		{"* * * * 8", false, false},
+	}
+	for _, test := range tests {
+		if matched, valid := window(test.spec, now); matched != test.matched || valid != test.valid {
+			t.Errorf("window(%q) = %v, %v, want %v, %v", test.spec, matched, valid, test.matched, test.valid)
+		}
+	}
+	if !opened(nil, now) || opened([]string{"0 3 * * *", "bad"}, now) || !opened([]string{"0 3 * * *", "30 2 * * *"}, now) {
+		t.Errorf("opened() mismatch")
+	}
+}
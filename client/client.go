@@ -7,9 +7,12 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pyke369/golang-support/ustr"
+
+	"ptftp/netascii"
 )
 
 func bail(message string, exit int) {
@@ -26,10 +29,15 @@ func Run() {
 		bail(err.Error(), 2)
 	}
 
-	rfile, lfile, target := os.Args[2], "", os.Stdout
+	rfile, lfile, mode, target, decoder := os.Args[2], "", "octet", os.Stdout, &netascii.Decoder{}
 	if len(os.Args) >= 4 {
 		lfile = os.Args[3]
 	}
+	if len(os.Args) >= 5 {
+		if mode = strings.ToLower(os.Args[4]); mode != "octet" && mode != "netascii" {
+			bail("unknown transfer mode", 2)
+		}
+	}
 	if lfile == "" {
 		lfile = path.Base(rfile)
 	}
@@ -56,7 +64,7 @@ func Run() {
 		packet = packet[:0]
 		packet = append(packet, []byte{0, 1}...)
 		packet = append(packet, append([]byte(rfile), 0)...)
-		packet = append(packet, append([]byte("octet"), 0)...)
+		packet = append(packet, append([]byte(mode), 0)...)
 		packet = append(packet, append([]byte("blksize"), 0)...)
 		packet = append(packet, append([]byte("16384"), 0)...)
 		packet = append(packet, append([]byte("tsize"), 0)...)
@@ -83,8 +91,14 @@ func Run() {
 					receiving, retries = true, 0
 					if size >= 4 {
 						block = binary.BigEndian.Uint16(packet[2:])
-						if lsize = len(packet) - 4; lsize > 0 {
-							if written, err := target.Write(packet[4:]); err != nil || written != lsize {
+						if lsize = len(packet) - 4; lsize > 0 || mode == "netascii" {
+							content := packet[4:]
+							if mode == "netascii" {
+								if content = decoder.Decode(content); lsize < blksize {
+									content = append(content, decoder.Flush()...)
+								}
+							}
+							if written, err := target.Write(content); err != nil || written != len(content) {
 								bail(err.Error(), 3)
 							}
 						}
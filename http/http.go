@@ -1,10 +1,10 @@
 package http
 
 import (
+	"errors"
+	"io"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/pyke369/golang-support/rcache"
@@ -13,15 +13,15 @@ import (
 	"github.com/pyke369/golang-support/ustr"
 
 	b "ptftp/backend"
-	c "ptftp/cache"
 	"ptftp/common"
+	"ptftp/route"
 )
 
 func Handler(config *uconfig.UConfig, logger *ulog.ULog) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 
-		file := strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(r.URL.Path, "../", ""), "./", ""), "&", ""), ";", "")
-		status, timeout, tsize, mode, target, ftarget, content, headers, env, begin, end, sent := 200, 10, int64(-1), "", "", "", []byte{}, map[string]string{}, []string{}, int64(0), int64(-1), int64(0)
+		file := route.Clean(r.URL.Path)
+		status, timeout, tsize, mode, begin, end, sent := 200, 10, int64(-1), "", int64(0), int64(-1), int64(0)
 		start := time.Now()
 		logger.Info(map[string]any{"scope": "http", "event": "request", "file": file, "remote": r.RemoteAddr})
 		defer func() {
@@ -44,74 +44,14 @@ func Handler(config *uconfig.UConfig, logger *ulog.ULog) http.Handler {
 		}
 
 		// check routes/backends and gather requested file information
-		for _, path := range config.Paths("routes") {
-			if route := config.String(path); route != "" {
-				if match := config.String(config.Path("routes", route, "match")); match != "" {
-					if matcher := rcache.Get(match); matcher.MatchString(file) {
-						for _, path := range config.Paths(config.Path("routes", route, "backends")) {
-							backend := config.String(path)
-							mode = strings.ToLower(config.String(config.Path("routes", route, backend, "mode")))
-							target = matcher.ReplaceAllString(file, config.String(config.Path("routes", route, backend, "target")))
-							switch mode {
-							case "file":
-								ftarget = target
-								tsize, _, _ = b.File(target, 0, 1)
-
-							case "http":
-								for _, path := range config.Paths(config.Path("routes", route, backend, "headers")) {
-									if value := strings.TrimSpace(config.String(path)); value != "" {
-										if parts := strings.Split(value, ":"); len(parts) > 1 {
-											headers[parts[0]] = matcher.ReplaceAllString(file, strings.TrimSpace(strings.Join(parts[1:], ":")))
-										}
-									}
-								}
-								tsize, _, _ = b.HTTP(target, 0, 1, timeout, headers)
-								if tsize >= 0 {
-									for _, policy := range config.Strings(config.Path("routes", route, backend, "cache", "policies")) {
-										prefix := config.Path("routes", route, backend, "cache", policy)
-										if match = config.String(config.Path(prefix, "match")); match != "" {
-											if cmatcher := rcache.Get(match); cmatcher != nil && cmatcher.MatchString(file) {
-												if path := matcher.ReplaceAllString(file, config.String(config.Path(prefix, "path"))); path != "" {
-													c.Queue(&c.Job{
-														Trigger:     "http",
-														Remote:      target,
-														Local:       path,
-														Headers:     headers,
-														Delay:       config.DurationBounds(config.Path(prefix, "delay"), 5, 1, 60),
-														Concurrency: int(config.IntegerBounds(config.Path(prefix, "concurrency"), 8, 1, 16)),
-														Refresh:     int(config.DurationBounds(config.Path(prefix, "refresh"), 0, 0, 30*86400)),
-													})
-													break
-												}
-											}
-										}
-									}
-								}
-
-							case "exec":
-								for _, path := range config.Paths(config.Path("routes", route, backend, "env")) {
-									if value := strings.TrimSpace(config.String(path)); value != "" {
-										if parts := strings.Split(value, ":"); len(parts) > 1 {
-											env = append(env, parts[0]+"="+matcher.ReplaceAllString(file, strings.TrimSpace(strings.Join(parts[1:], ":"))))
-										}
-									}
-								}
-								tsize, content, _ = b.Exec(target, timeout, env)
-							}
-							if tsize >= 0 {
-								break
-							}
-						}
-						break
-					}
-				}
-			}
-		}
-		if tsize < 0 {
+		source := route.Resolve("http", file, timeout)
+		if source == nil {
 			status = http.StatusNotFound
 			rw.WriteHeader(status)
 			return
 		}
+		defer source.Close()
+		mode, tsize = source.Mode, source.Size
 		if tsize == 0 {
 			rw.Header().Set("Content-Length", "0")
 			return
@@ -146,30 +86,33 @@ func Handler(config *uconfig.UConfig, logger *ulog.ULog) http.Handler {
 			return
 		}
 
-		// send requested content
+		// send requested content (straight from the descriptor for file backed content, using a bounded buffer otherwise)
 		start = time.Now()
-		toffset := begin
+		if handle := source.Handle(); handle != nil {
+			if _, err := handle.Seek(begin, io.SeekStart); err == nil {
+				mode = source.Mode
+				sent, _ = io.Copy(rw, io.LimitReader(handle, end-begin+1))
+				return
+			}
+		}
+		toffset, content := begin, make([]byte, min(end-begin+1, config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20)))
 		for {
-			bsize := min(end-toffset+1, config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20))
+			bsize := min(end-toffset+1, int64(len(content)))
 			if bsize <= 0 {
 				break
 			}
-			if mode == "http" && ftarget != "" {
-				if info, err := os.Stat(ftarget); err == nil && info.Mode().IsRegular() && info.Size() == tsize {
-					mode, target = "file", ftarget
-				}
+			read, err := source.ReadAt(content[:bsize], toffset)
+			mode = source.Mode
+			if errors.Is(err, b.ErrChanged) {
+				// headers are already out: drop the connection rather than mixing two versions of the content
+				logger.Warn(map[string]any{"scope": "http", "event": "error", "remote": r.RemoteAddr, "file": file, "mode": mode,
+					"size": tsize, "sent": sent, "message": err.Error()})
+				panic(http.ErrAbortHandler)
 			}
-			switch mode {
-			case "file":
-				_, content, _ = b.File(target, toffset, bsize)
-
-			case "http":
-				_, content, _ = b.HTTP(target, toffset, bsize, timeout, headers)
-
-			case "exec":
-				content = content[begin : begin+bsize]
+			if read == 0 {
+				break
 			}
-			if size, err := rw.Write(content); err != nil {
+			if size, err := rw.Write(content[:read]); err != nil {
 				break
 
 			} else {
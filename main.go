@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	a "ptftp/admin"
 	c "ptftp/client"
 	"ptftp/common"
 	s "ptftp/server"
@@ -15,7 +16,11 @@ func usage() {
 	os.Stderr.WriteString("usage:\n\n" +
 		progname + " version\n" +
 		progname + " server <configuration>\n" +
-		progname + " <host>[:<port>] <remote> [<local>]\n",
+		progname + " cache <configuration> list|verify [<pattern>...]\n" +
+		progname + " cache <configuration> purge <path|pattern>...\n" +
+		progname + " cache <configuration> prefetch <file>...|-\n" +
+		progname + " cache <configuration> clean|jobs\n" +
+		progname + " <host>[:<port>] <remote> [<local> [octet|netascii]]\n",
 	)
 	os.Exit(1)
 }
@@ -29,6 +34,9 @@ func main() {
 		case "server":
 			s.Run()
 
+		case "cache":
+			a.Run()
+
 		default:
 			if len(os.Args) < 3 {
 				usage()
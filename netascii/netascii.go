@@ -0,0 +1,74 @@
+package netascii
+
+// netascii (RFC764) uses CR LF as line terminator and CR NUL for a bare CR
+
+func Size(in []byte) (size int64) {
+	size = int64(len(in))
+	for _, value := range in {
+		if value == '\n' || value == '\r' {
+			size++
+		}
+	}
+
+	return size
+}
+
+func Encode(in []byte) (out []byte) {
+	out = make([]byte, 0, Size(in))
+	for _, value := range in {
+		switch value {
+		case '\n':
+			out = append(out, '\r', '\n')
+
+		case '\r':
+			out = append(out, '\r', 0)
+
+		default:
+			out = append(out, value)
+		}
+	}
+
+	return out
+}
+
+// Decoder keeps track of a trailing CR across consecutive blocks
+type Decoder struct {
+	pending bool
+}
+
+func (d *Decoder) Decode(in []byte) (out []byte) {
+	out = make([]byte, 0, len(in)+1)
+	for _, value := range in {
+		if d.pending {
+			d.pending = false
+			switch value {
+			case '\n':
+				out = append(out, '\n')
+				continue
+
+			case 0:
+				out = append(out, '\r')
+				continue
+
+			default:
+				out = append(out, '\r')
+			}
+		}
+		if value == '\r' {
+			d.pending = true
+			continue
+		}
+		out = append(out, value)
+	}
+
+	return out
+}
+
+func (d *Decoder) Flush() (out []byte) {
+	if d.pending {
+		d.pending = false
+		out = append(out, '\r')
+	}
+
+	return out
+}
@@ -0,0 +1,52 @@
+package netascii
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks []string
+		out    string
+	}{
+		{"empty", []string{""}, ""},
+		{"plain", []string{"abc"}, "abc"},
+		{"line", []string{"a\r\nb"}, "a\nb"},
+		{"bare cr", []string{"a\r\x00b"}, "a\rb"},
+		{"cr lf split", []string{"a\r", "\nb"}, "a\nb"},
+		{"cr nul split", []string{"a\r", "\x00b"}, "a\rb"},
+		{"cr other split", []string{"a\r", "b"}, "a\rb"},
+		{"cr alone block", []string{"a", "\r", "\n", "b"}, "a\nb"},
+		{"trailing cr", []string{"a\r"}, "a\r"},
+		{"double cr split", []string{"\r", "\r\n"}, "\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder, out := &Decoder{}, []byte{}
+			for _, block := range test.blocks {
+				out = append(out, decoder.Decode([]byte(block))...)
+			}
+			out = append(out, decoder.Flush()...)
+			if !bytes.Equal(out, []byte(test.out)) {
+				t.Errorf("Decode(%q) = %q, want %q", test.blocks, out, test.out)
+			}
+		})
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	in := []byte("line 1\nbare\rcr\r\nend\r")
+	encoded := Encode(in)
+	if int64(len(encoded)) != Size(in) {
+		t.Errorf("Size() = %d, want %d", Size(in), len(encoded))
+	}
+	for split := range encoded {
+		decoder := &Decoder{}
+		out := append(decoder.Decode(encoded[:split]), decoder.Decode(encoded[split:])...)
+		if out = append(out, decoder.Flush()...); !bytes.Equal(out, in) {
+			t.Errorf("split at %d: decoded %q, want %q", split, out, in)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package route
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	b "ptftp/backend"
+	c "ptftp/cache"
+)
+
+// read-ahead pipeline: a background reader fetches the chunks following the last one read (all backend accesses of
+// a transfer happening from this reader while it runs), within a global memory budget shared by all transfers
+type chunk struct {
+	offset  int64
+	content []byte
+	err     error
+}
+
+type ahead struct {
+	next   int64
+	chunks chan *chunk
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var (
+	depth    int
+	budget   int64
+	reserved atomic.Int64
+)
+
+func reserve(size int64) bool {
+	if reserved.Add(size) > budget {
+		reserved.Add(-size)
+		return false
+	}
+
+	return true
+}
+
+func (s *Source) prefetch(offset, length int64) {
+	a := &ahead{next: offset, chunks: make(chan *chunk, depth), stop: make(chan struct{}), done: make(chan struct{})}
+	s.ahead = a
+	go func() {
+		defer close(a.done)
+		defer close(a.chunks)
+		for offset < s.Size {
+			select {
+			case <-a.stop:
+				return
+
+			default:
+			}
+			if !reserve(length) {
+				return
+			}
+			item := &chunk{offset: offset, content: make([]byte, length)}
+			read, err := s.read(item.content, offset)
+			item.content, item.err = item.content[:read], err
+			select {
+			case a.chunks <- item:
+
+			case <-a.stop:
+				reserved.Add(-length)
+				return
+			}
+			if err != nil || read == 0 {
+				return
+			}
+			offset += int64(read)
+		}
+	}()
+}
+
+func (s *Source) unprefetch() {
+	if s.ahead != nil {
+		close(s.ahead.stop)
+		for item := range s.ahead.chunks {
+			reserved.Add(-int64(cap(item.content)))
+		}
+		<-s.ahead.done
+		s.ahead = nil
+	}
+}
+
+// ReadAt serves sequential reads from the pipeline, any other read (or a chunk size change) restarting it
+func (s *Source) ReadAt(content []byte, offset int64) (read int, err error) {
+	if s.ahead != nil {
+		if offset != s.ahead.next || s.cached() {
+			s.unprefetch()
+
+		} else if item := <-s.ahead.chunks; item != nil {
+			reserved.Add(-int64(cap(item.content)))
+			if item.offset == offset && (len(item.content) >= len(content) || item.err != nil) {
+				read = copy(content, item.content)
+				s.ahead.next += int64(read)
+				if read < len(content) {
+					err = item.err
+				}
+				return read, err
+			}
+			s.unprefetch()
+
+		} else {
+			s.unprefetch()
+		}
+	}
+	s.local()
+	if read, err = s.read(content, offset); err == nil && read == len(content) && depth > 0 && s.Mode == "http" {
+		s.prefetch(offset+int64(read), int64(len(content)))
+	}
+
+	return read, err
+}
+
+// http sources being cached are read from the partial local copy (of the same remote content version), the origin only
+// being asked for what is still missing after a while
+func (s *Source) read(content []byte, offset int64) (read int, err error) {
+	if s.Mode == "http" && s.Local != "" {
+		if progress := c.Lookup(s.Local); progress != nil {
+			if etag, modified := progress.Version(); progress.Size() == s.Size && s.pinned(etag, modified) {
+				read, err = progress.ReadAt(content, offset, 2*time.Second)
+			}
+			progress.Release()
+			if read != 0 || errors.Is(err, io.EOF) {
+				return read, err
+			}
+		}
+		if s.cached() {
+			// download completed in the meantime (the pipeline reader not switching the source backend itself)
+			_, chunk, err := b.File(s.Local, offset, int64(len(content)))
+			if read = copy(content, chunk); err == nil && read < len(content) {
+				err = io.EOF
+			}
+			return read, err
+		}
+	}
+
+	return s.Backend.ReadAt(content, offset)
+}
+
+func (s *Source) Close() error {
+	s.unprefetch()
+	c.Done(s.used)
+
+	return s.Backend.Close()
+}
@@ -0,0 +1,515 @@
+package route
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pyke369/golang-support/file"
+	"github.com/pyke369/golang-support/rcache"
+	"github.com/pyke369/golang-support/uconfig"
+
+	b "ptftp/backend"
+	c "ptftp/cache"
+)
+
+type Template struct {
+	Name  string
+	Value string
+}
+
+type Policy struct {
+	Name        string
+	Matcher     *regexp.Regexp
+	Path        string
+	Delay       time.Duration
+	Concurrency int
+	Refresh     int
+	MaxSize     int64
+	Eviction    string
+	Checksum    *c.Checksum
+	Manifest    string
+	Windows     []string
+	Connections int
+	Bandwidth   int64
+}
+
+type Backend struct {
+	Name        string
+	Path        string
+	Mode        string
+	Target      string
+	Headers     []*Template
+	Env         []*Template
+	Transport   *b.Transport
+	NoRange     bool
+	MetadataTTL time.Duration
+	Policies    []*Policy
+	MaxSize     int64
+	Create      bool
+	Overwrite   bool
+}
+
+type Route struct {
+	Name     string
+	Matcher  *regexp.Regexp
+	Backends []*Backend
+	Uploads  []*Backend
+}
+
+// Source is an opened backend along with the route/backend definitions it was resolved from
+type Source struct {
+	b.Backend
+	File     string
+	Route    *Route
+	Settings *Backend
+	Mode     string
+	Target   string
+	Local    string
+	Headers  map[string]string
+	Env      []string
+	Size     int64
+	used     string
+	ahead    *ahead
+}
+
+var (
+	current *uconfig.UConfig
+	routes  []*Route
+)
+
+func templates(config *uconfig.UConfig, path string) (out []*Template) {
+	for _, path := range config.Paths(path) {
+		if value := strings.TrimSpace(config.String(path)); value != "" {
+			if parts := strings.Split(value, ":"); len(parts) > 1 {
+				out = append(out, &Template{Name: parts[0], Value: strings.TrimSpace(strings.Join(parts[1:], ":"))})
+			}
+		}
+	}
+
+	return out
+}
+
+// transport settings are read from the backend section, falling back to the global section (except for TLS settings,
+// which are origin specific)
+func transport(config *uconfig.UConfig, prefix string) *b.Transport {
+	global, local := "transport", config.Path(prefix, "transport")
+
+	return &b.Transport{
+		IdleConnections: int(config.IntegerBounds(config.Path(local, "idle_connections"),
+			config.IntegerBounds(config.Path(global, "idle_connections"), int64(b.DefaultTransport.IdleConnections), 1, 4096), 1, 4096)),
+		ConnectionsPerHost: int(config.IntegerBounds(config.Path(local, "connections_per_host"),
+			config.IntegerBounds(config.Path(global, "connections_per_host"), int64(b.DefaultTransport.ConnectionsPerHost), 0, 4096), 0, 4096)),
+		IdleTimeout: config.DurationBounds(config.Path(local, "idle_timeout"),
+			uconfig.Seconds(config.DurationBounds(config.Path(global, "idle_timeout"), uconfig.Seconds(b.DefaultTransport.IdleTimeout), 1, 3600)), 1, 3600),
+		HTTP2: config.Boolean(config.Path(local, "http2"), config.Boolean(config.Path(global, "http2"), b.DefaultTransport.HTTP2)),
+		TLS: b.TLS{
+			Verify:     config.Boolean(config.Path(prefix, "tls", "verify"), b.DefaultTransport.TLS.Verify),
+			CA:         strings.TrimSpace(config.String(config.Path(prefix, "tls", "ca"))),
+			Cert:       strings.TrimSpace(config.String(config.Path(prefix, "tls", "cert"))),
+			Key:        strings.TrimSpace(config.String(config.Path(prefix, "tls", "key"))),
+			MinVersion: b.TLSVersion(config.String(config.Path(prefix, "tls", "min_version"), "1.2")),
+			ServerName: strings.TrimSpace(config.String(config.Path(prefix, "tls", "server_name"))),
+		},
+	}
+}
+
+func checksum(config *uconfig.UConfig, prefix string) *c.Checksum {
+	checksum := &c.Checksum{
+		URL:      strings.TrimSpace(config.String(config.Path(prefix, "url"))),
+		Manifest: strings.TrimSpace(config.String(config.Path(prefix, "manifest"))),
+		Header:   strings.TrimSpace(config.String(config.Path(prefix, "header"))),
+	}
+	if checksum.URL == "" && checksum.Manifest == "" && checksum.Header == "" {
+		return nil
+	}
+
+	return checksum
+}
+
+func windows(config *uconfig.UConfig, path string) (out []string) {
+	for _, spec := range config.Strings(path) {
+		if spec = strings.TrimSpace(spec); c.Window(spec) {
+			out = append(out, spec)
+		}
+	}
+
+	return out
+}
+
+// backends with unusable TLS settings are rejected (and reported) instead of failing every request to their origin
+func backends(config *uconfig.UConfig, route, list string) (out []*Backend, errs []error) {
+	for _, path := range config.Paths(config.Path("routes", route, list)) {
+		name := config.String(path)
+		prefix := config.Path("routes", route, name)
+		backend := &Backend{
+			Name:        name,
+			Path:        prefix,
+			Mode:        strings.ToLower(config.String(config.Path(prefix, "mode"))),
+			Target:      config.String(config.Path(prefix, "target")),
+			Headers:     templates(config, config.Path(prefix, "headers")),
+			Env:         templates(config, config.Path(prefix, "env")),
+			Transport:   transport(config, prefix),
+			NoRange:     !config.Boolean(config.Path(prefix, "ranges"), true),
+			MetadataTTL: config.DurationBounds(config.Path(prefix, "metadata_ttl"), 0, 0, 86400),
+			MaxSize:     config.Size(config.Path(prefix, "max_size"), 0),
+			Create:      config.Boolean(config.Path(prefix, "create"), true),
+			Overwrite:   config.Boolean(config.Path(prefix, "overwrite"), false),
+		}
+		if err := backend.Transport.Check(); err != nil {
+			errs = append(errs, errors.New(prefix+": "+err.Error()))
+			continue
+		}
+		for _, policy := range config.Strings(config.Path(prefix, "cache", "policies")) {
+			prefix := config.Path(prefix, "cache", policy)
+			if match := config.String(config.Path(prefix, "match")); match != "" {
+				if matcher := rcache.Get(match); matcher != nil {
+					backend.Policies = append(backend.Policies, &Policy{
+						Name:        policy,
+						Matcher:     matcher,
+						Path:        config.String(config.Path(prefix, "path")),
+						Delay:       config.DurationBounds(config.Path(prefix, "delay"), 5, 1, 60),
+						Concurrency: int(config.IntegerBounds(config.Path(prefix, "concurrency"), 8, 1, 16)),
+						Refresh:     int(config.DurationBounds(config.Path(prefix, "refresh"), 0, 0, 30*86400) / time.Second),
+						MaxSize:     config.Size(config.Path(prefix, "max_size"), 0),
+						Eviction:    strings.ToLower(config.String(config.Path(prefix, "eviction"), "lru")),
+						Checksum:    checksum(config, config.Path(prefix, "checksum")),
+						Manifest:    strings.TrimSpace(config.String(config.Path(prefix, "manifest"))),
+						Windows:     windows(config, config.Path(prefix, "windows")),
+						Connections: int(config.IntegerBounds(config.Path(prefix, "connections"), 0, 0, 4096)),
+						Bandwidth:   config.SizeBounds(config.Path(prefix, "bandwidth"), 0, 0, 100<<30),
+					})
+				}
+			}
+		}
+		out = append(out, backend)
+	}
+
+	return out, errs
+}
+
+// routes are evaluated in name order, the first matching one being used to resolve a file; the rejected backends
+// are returned for the caller to report
+func Load(config *uconfig.UConfig) (errs []error) {
+	current = config
+	depth, budget = int(config.IntegerBounds("prefetch_depth", 1, 0, 16)), config.SizeBounds("prefetch_memory", 256<<20, 0, 64<<30)
+	b.Hot(config.SizeBounds(config.Path("hot_objects", "size"), 64<<20, 0, 64<<30), config.SizeBounds(config.Path("hot_objects", "max_object"), 1<<20, 0, 1<<30),
+		config.DurationBounds(config.Path("hot_objects", "ttl"), 0, 0, 86400))
+	names := []string{}
+	for _, path := range config.Paths("routes") {
+		name := config.String(path)
+		if name == "" {
+			name = config.Base(path)
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	compiled := []*Route{}
+	for _, name := range names {
+		if match := config.String(config.Path("routes", name, "match")); match != "" {
+			if matcher := rcache.Get(match); matcher != nil {
+				downloads, rejected := backends(config, name, "backends")
+				errs = append(errs, rejected...)
+				uploads, rejected := backends(config, name, "uploads")
+				errs = append(errs, rejected...)
+				compiled = append(compiled, &Route{
+					Name:     name,
+					Matcher:  matcher,
+					Backends: downloads,
+					Uploads:  uploads,
+				})
+			}
+		}
+	}
+	routes = compiled
+
+	// cache roots (the static part of the policies paths) are bounded by the policies sizes and the minimum free space
+	c.Reset(config.Size("cache_min_free", 0))
+	for _, route := range compiled {
+		for _, backend := range route.Backends {
+			for _, policy := range backend.Policies {
+				if root := root(policy.Path); root != "." && root != string(filepath.Separator) {
+					c.Limit(root, policy.MaxSize, policy.Eviction)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// Clean strips the sequences a requested file name could use to escape its route targets (the removal being
+// repeated until nothing is left to remove, so that removed characters cannot reassemble a parent reference)
+func Clean(file string) string {
+	for {
+		cleaned := strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(file, "&", ""), ";", ""), "../", ""), "./", "")
+		if cleaned == file {
+			return strings.TrimSpace(cleaned)
+		}
+		file = cleaned
+	}
+}
+
+// root returns the fixed directory part of a target template (before its first substitution)
+func root(template string) string {
+	prefix, _, _ := strings.Cut(template, "$")
+
+	return filepath.Dir(prefix + "_")
+}
+
+// contained tells whether an expanded target stays under the fixed directory of its template
+func contained(template, target string) bool {
+	relative, err := filepath.Rel(root(template), filepath.Clean(target))
+
+	return err == nil && filepath.IsLocal(relative)
+}
+
+func match(file string) *Route {
+	for _, route := range routes {
+		if route.Matcher.MatchString(file) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+func (s *Source) expand(value string) string {
+	return s.Route.Matcher.ReplaceAllString(s.File, value)
+}
+
+func (s *Source) request(backend *Backend, timeout int) *b.Request {
+	s.Settings, s.Mode, s.Target = backend, backend.Mode, s.expand(backend.Target)
+	s.Headers, s.Env = map[string]string{}, []string{}
+	for _, header := range backend.Headers {
+		s.Headers[header.Name] = s.expand(header.Value)
+	}
+	for _, env := range backend.Env {
+		s.Env = append(s.Env, env.Name+"="+s.expand(env.Value))
+	}
+
+	return &b.Request{
+		Mode:        s.Mode,
+		Target:      s.Target,
+		Headers:     s.Headers,
+		Env:         s.Env,
+		Timeout:     timeout,
+		Transport:   backend.Transport,
+		NoRange:     backend.NoRange,
+		Limit:       backend.MaxSize,
+		Create:      backend.Create,
+		Overwrite:   backend.Overwrite,
+		MetadataTTL: backend.MetadataTTL,
+		Config:      current,
+		Path:        backend.Path,
+	}
+}
+
+// Resolve walks the backends of the route matching file and returns the first available source, queuing a cache
+// job if the selected backend has a matching cache policy (the source must be closed by the caller)
+func Resolve(trigger, file string, timeout int) (source *Source) {
+	route := match(file)
+	if route == nil {
+		return nil
+	}
+	source = &Source{File: file, Route: route, Size: -1}
+	for _, settings := range route.Backends {
+		request := source.request(settings, timeout)
+		source.Local = ""
+		if source.Mode == "file" {
+			source.Local = source.Target
+		}
+		backend := b.Memory(request)
+		if backend == nil {
+			var err error
+			if backend, err = b.Open(request); err != nil {
+				continue
+			}
+			if source.Size, err = backend.Stat(); err != nil || source.Size < 0 {
+				backend.Close()
+				continue
+			}
+			backend = b.Remember(request, backend, source.Size)
+		}
+		source.Size, _ = backend.Stat()
+		source.Backend = backend
+		if policy, path := source.policy(settings); policy != nil {
+			if source.Mode == "http" {
+				source.Local = path
+			}
+			c.Queue(source.job(trigger, policy, path, false))
+		}
+
+		// expired cached copies keep being served while the http backend they were fetched from revalidates them
+		if source.Mode == "file" && c.Expired(source.Target) {
+			for _, settings := range route.Backends {
+				if settings.Mode == "http" {
+					remote := &Source{File: file, Route: route}
+					remote.request(settings, timeout)
+					if policy, path := remote.policy(settings); policy != nil && path == source.Target {
+						c.Queue(remote.job(trigger, policy, path, true))
+						break
+					}
+				}
+			}
+		}
+		source.used = source.Local
+		c.Use(source.used)
+		return source
+	}
+
+	return nil
+}
+
+// policy returns the first cache policy of backend matching the source file, along with its local path
+func (s *Source) policy(backend *Backend) (*Policy, string) {
+	for _, policy := range backend.Policies {
+		if policy.Matcher.MatchString(s.File) {
+			if path := s.expand(policy.Path); path != "" {
+				return policy, path
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+func (s *Source) job(trigger string, policy *Policy, path string, revalidate bool) *c.Job {
+	checksum := (*c.Checksum)(nil)
+	if policy.Checksum != nil {
+		checksum = &c.Checksum{Header: policy.Checksum.Header}
+		if policy.Checksum.URL != "" {
+			checksum.URL = s.expand(policy.Checksum.URL)
+		}
+		if policy.Checksum.Manifest != "" {
+			checksum.Manifest = s.expand(policy.Checksum.Manifest)
+		}
+	}
+
+	// warm-up and refresh downloads are restricted to the policy prefetch windows, not the ones clients wait for
+	windows := []string(nil)
+	if trigger == "warmup" || revalidate {
+		windows = policy.Windows
+	}
+
+	return &c.Job{
+		Trigger:     trigger,
+		Remote:      s.Target,
+		Local:       path,
+		Headers:     s.Headers,
+		Transport:   s.Settings.Transport,
+		NoRange:     s.Settings.NoRange,
+		Delay:       policy.Delay,
+		Concurrency: policy.Concurrency,
+		Refresh:     policy.Refresh,
+		Revalidate:  revalidate,
+		Checksum:    checksum,
+		Windows:     windows,
+		Policy:      s.Route.Name + "/" + s.Settings.Name + "/" + policy.Name,
+		Connections: policy.Connections,
+		Bandwidth:   policy.Bandwidth,
+	}
+}
+
+// Job returns the cache job an http backend of the route matching file would queue, nil if there is none (or if the
+// local copy is there and still fresh, expired ones being revalidated)
+func Job(trigger, file string) *c.Job {
+	route := match(file)
+	if route == nil {
+		return nil
+	}
+	for _, settings := range route.Backends {
+		if settings.Mode == "http" {
+			source := &Source{File: file, Route: route}
+			source.request(settings, 0)
+			if policy, path := source.policy(settings); policy != nil {
+				revalidate := false
+				if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+					if !c.Expired(path) {
+						return nil
+					}
+					revalidate = true
+				}
+				return source.job(trigger, policy, path, revalidate)
+			}
+		}
+	}
+
+	return nil
+}
+
+// http sources switch to the local copy as soon as a cache job has completed it, provided it is the very version the
+// transfer is pinned to (as recorded in the cache sidecar)
+func (s *Source) cached() bool {
+	if s.Mode == "http" && s.Local != "" {
+		if info := file.IsRegular(s.Local); info != nil && info.Size() == s.Size {
+			if metadata := c.Meta(s.Local); metadata != nil {
+				return s.pinned(metadata.ETag, metadata.Modified)
+			}
+		}
+	}
+
+	return false
+}
+
+// pinned tells whether validators match the ones of the remote content version the source is pinned to
+func (s *Source) pinned(etag, modified string) bool {
+	if versioned, ok := s.Backend.(b.Versioned); ok {
+		current, last := versioned.Version()
+		return current+last != "" && etag == current && modified == last
+	}
+
+	return false
+}
+
+func (s *Source) local() {
+	if s.cached() {
+		if backend, err := b.Open(&b.Request{Mode: "file", Target: s.Local}); err == nil {
+			s.Backend.Close()
+			s.Backend, s.Mode, s.Target = backend, "file", s.Local
+		}
+	}
+}
+
+// Handle returns the descriptor of file backed sources (including completed cache copies), nil otherwise
+func (s *Source) Handle() *os.File {
+	s.local()
+	if filer, ok := s.Backend.(b.Filer); ok {
+		return filer.File()
+	}
+
+	return nil
+}
+
+// Upload walks the upload backends of the route matching file and opens the first accepting sink
+func Upload(file string, size int64) (source *Source, sink b.Sink, err error) {
+	err = os.ErrPermission
+	route := match(file)
+	if route == nil {
+		return nil, nil, err
+	}
+	source = &Source{File: file, Route: route, Size: size}
+	for _, settings := range route.Uploads {
+		request := source.request(settings, 0)
+		if !contained(settings.Target, request.Target) {
+			err = os.ErrPermission
+			continue
+		}
+		if settings.MaxSize > 0 && size > settings.MaxSize {
+			err = b.ErrTooLarge
+			continue
+		}
+		if sink, err = b.OpenSink(request); err == nil {
+			return source, sink, nil
+		}
+	}
+
+	return nil, nil, err
+}
@@ -0,0 +1,54 @@
+package route
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pyke369/golang-support/file"
+	"github.com/pyke369/golang-support/ulog"
+
+	c "ptftp/cache"
+)
+
+// cache policies may list files (one per line, named as clients request them) to be cached ahead of any request,
+// their manifest being read again when modified or at least every hour (already cached files being skipped, expired
+// ones revalidated)
+func Warmup(logger *ulog.ULog) {
+	scanned := map[string]time.Time{}
+	for {
+		manifests := map[string]bool{}
+		for _, route := range routes {
+			for _, backend := range route.Backends {
+				for _, policy := range backend.Policies {
+					if policy.Manifest != "" {
+						manifests[policy.Manifest] = true
+					}
+				}
+			}
+		}
+		for manifest := range manifests {
+			info, err := os.Stat(manifest)
+			if err != nil {
+				continue
+			}
+			if last, exists := scanned[manifest]; exists && info.ModTime().Before(last) && time.Since(last) < time.Hour {
+				continue
+			}
+			scanned[manifest] = time.Now()
+			queued := 0
+			for _, line := range file.Read(manifest) {
+				if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				if job := Job("warmup", line); job != nil {
+					job.Delay = 0
+					c.Queue(job)
+					queued++
+				}
+			}
+			logger.Info(map[string]any{"scope": "cache", "event": "warmup", "manifest": manifest, "queued": queued})
+		}
+		time.Sleep(time.Minute)
+	}
+}
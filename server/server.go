@@ -11,9 +11,11 @@ import (
 	"github.com/pyke369/golang-support/uconfig"
 	"github.com/pyke369/golang-support/ulog"
 
+	b "ptftp/backend"
 	c "ptftp/cache"
 	"ptftp/common"
 	h "ptftp/http"
+	r "ptftp/route"
 	t "ptftp/tftp"
 )
 
@@ -32,7 +34,11 @@ func Run() {
 	logger.SetOrder([]string{"scope", "event", "version", "config", "pid", "listen", "trigger", "remote", "local", "size", "duration", "bandwidth"})
 	logger.Info(map[string]any{"scope": "server", "event": "start", "version": common.PROGVER, "config": path, "pid": os.Getpid()})
 
+	for _, err := range r.Load(config) {
+		logger.Warn(map[string]any{"scope": "server", "event": "reject", "message": err.Error()})
+	}
 	c.Run(config, logger)
+	go r.Warmup(logger)
 
 	for _, listen := range config.Strings("listen") {
 		parts := strings.Split(listen, "@")
@@ -53,7 +59,7 @@ func Run() {
 							for {
 								packet = packet[:cap(packet)]
 								if size, remote, err := handle.ReadFromUDP(packet); err == nil && size > 2 {
-									go t.Handle(config, logger, packet[:size], handle.LocalAddr().String(), remote.String())
+									go t.Handle(config, logger, append([]byte{}, packet[:size]...), handle.LocalAddr().String(), remote.String())
 								}
 							}
 						}
@@ -81,5 +87,10 @@ func Run() {
 		}
 	}
 
-	select {}
+	// report hot objects cache efficiency
+	for range time.Tick(time.Minute) {
+		if hit, miss, count, size := b.HotStats(); hit+miss != 0 {
+			logger.Info(map[string]any{"scope": "memory", "event": "stats", "hits": hit, "misses": miss, "objects": count, "size": size})
+		}
+	}
 }
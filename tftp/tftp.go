@@ -3,21 +3,66 @@ package tftp
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"math"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/pyke369/golang-support/rcache"
 	"github.com/pyke369/golang-support/uconfig"
 	"github.com/pyke369/golang-support/ulog"
 	"github.com/pyke369/golang-support/ustr"
 
 	b "ptftp/backend"
-	c "ptftp/cache"
+	"ptftp/netascii"
+	"ptftp/route"
 )
 
+const (
+	stateOptions = iota
+	stateData
+)
+
+// negotiate validates requested options and builds the matching options acknowledgment packet
+func negotiate(options map[string]string, tsize int64) (oack []byte, blksize, timeout, wsize int) {
+	blksize, timeout, wsize = 512, 5, 1
+	if len(options) == 0 {
+		return
+	}
+	oack = append(oack, []byte{0x00, 0x06}...)
+	for name, value := range options {
+		if name == "blksize" {
+			if blksize, _ = strconv.Atoi(value); blksize < 8 || blksize > 65464 {
+				blksize = 512
+				continue
+			}
+		}
+		if name == "timeout" {
+			if timeout, _ = strconv.Atoi(value); timeout < 1 || timeout > 255 {
+				timeout = 5
+				continue
+			}
+		}
+		if name == "tsize" {
+			value = strconv.FormatInt(tsize, 10)
+		}
+		if name == "windowsize" {
+			if wsize, _ = strconv.Atoi(value); wsize < 1 || wsize > 65535 {
+				wsize = 1
+				continue
+			}
+		}
+		oack = append(oack, []byte(name)...)
+		oack = append(oack, 0)
+		oack = append(oack, []byte(value)...)
+		oack = append(oack, 0)
+	}
+
+	return
+}
+
 func Handle(config *uconfig.UConfig, logger *ulog.ULog, packet []byte, local, remote string) {
 	alocal, _ := net.ResolveUDPAddr("udp", local)
 	aremote, _ := net.ResolveUDPAddr("udp", remote)
@@ -29,22 +74,21 @@ func Handle(config *uconfig.UConfig, logger *ulog.ULog, packet []byte, local, re
 			}()
 
 			// check packet type and bail out if not a proper request
-			if opcode := binary.BigEndian.Uint16(packet); opcode != 1 {
-				handle.Write(append([]byte{0, 5, 0, 4}, append([]byte("read requests only"), 0)...))
+			opcode := binary.BigEndian.Uint16(packet)
+			if opcode != 1 && opcode != 2 {
+				handle.Write(append([]byte{0, 5, 0, 4}, append([]byte("illegal TFTP operation"), 0)...))
 				return
 			}
 
 			// parse packet (file, mode and options)
-			file, option, options, blksize, timeout, tsize, wsize := "", "", map[string]string{}, 512, 5, int64(-1), 1
-			mode, target, ftarget, content, headers, env := "", "", "", []byte{}, map[string]string{}, []string{}
+			file, transfer, option, options, timeout, tsize := "", "", "", map[string]string{}, 5, int64(-1)
 			for index, field := range bytes.Split(packet[2:], []byte{0}) {
 				switch index {
 				case 0:
-					file = string(bytes.TrimSpace(bytes.ReplaceAll(bytes.ReplaceAll(bytes.ReplaceAll(bytes.ReplaceAll(field,
-						[]byte("../"), []byte{}), []byte("./"), []byte{}), []byte("&"), []byte{}), []byte(";"), []byte{})))
+					file = route.Clean(string(field))
 
 				case 1:
-					if value := string(bytes.ToLower(field)); value != "netascii" && value != "octet" && value != "mail" {
+					if transfer = string(bytes.ToLower(field)); transfer != "netascii" && transfer != "octet" && transfer != "mail" {
 						handle.Write(append([]byte{0, 5, 0, 4}, append([]byte("unknown transfer mode"), 0)...))
 						return
 					}
@@ -67,157 +111,137 @@ func Handle(config *uconfig.UConfig, logger *ulog.ULog, packet []byte, local, re
 				soptions += name + "=" + value
 			}
 			logger.Info(map[string]any{"scope": "tftp", "event": "request", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
-				"options": strings.TrimSpace(soptions)})
+				"operation": map[uint16]string{1: "read", 2: "write"}[opcode], "options": strings.TrimSpace(soptions)})
+			if opcode == 2 {
+				receive(logger, handle, remote, file, transfer, options)
+				return
+			}
 
 			// check routes/backends and gather requested file information
 			if file == "" {
 				handle.Write(append([]byte{0, 5, 0, 1}, append([]byte("file not found"), 0)...))
 				return
 			}
-			for _, path := range config.Paths("routes") {
-				if route := config.String(path); route != "" {
-					if match := config.String(config.Path("routes", route, "match")); match != "" {
-						if matcher := rcache.Get(match); matcher != nil && matcher.MatchString(file) {
-							for _, path := range config.Paths(config.Path("routes", route, "backends")) {
-								backend := config.String(path)
-								mode = strings.ToLower(config.String(config.Path("routes", route, backend, "mode")))
-								target = matcher.ReplaceAllString(file, config.String(config.Path("routes", route, backend, "target")))
-								switch mode {
-								case "file":
-									ftarget = target
-									tsize, content, _ = b.File(target, 0, 64<<10)
-
-								case "http":
-									for _, path := range config.Paths(config.Path("routes", route, backend, "headers")) {
-										if value := strings.TrimSpace(config.String(path)); value != "" {
-											if parts := strings.Split(value, ":"); len(parts) > 1 {
-												headers[parts[0]] = matcher.ReplaceAllString(file, strings.TrimSpace(strings.Join(parts[1:], ":")))
-											}
-										}
-									}
-									tsize, content, _ = b.HTTP(target, 0, 64<<10, timeout, headers)
-									if tsize >= 0 {
-										for _, policy := range config.Strings(config.Path("routes", route, backend, "cache", "policies")) {
-											prefix := config.Path("routes", route, backend, "cache", policy)
-											if match = config.String(config.Path(prefix, "match")); match != "" {
-												if cmatcher := rcache.Get(match); cmatcher != nil && cmatcher.MatchString(file) {
-													if path := matcher.ReplaceAllString(file, config.String(config.Path(prefix, "path"))); path != "" {
-														c.Queue(&c.Job{
-															Trigger:     "tftp",
-															Remote:      target,
-															Local:       path,
-															Headers:     headers,
-															Delay:       config.DurationBounds(config.Path(prefix, "delay"), 5, 1, 60),
-															Concurrency: int(config.IntegerBounds(config.Path(prefix, "concurrency"), 8, 1, 16)),
-															Refresh:     int(config.DurationBounds(config.Path(prefix, "refresh"), 0, 0, 30*86400)),
-														})
-														break
-													}
-												}
-											}
-										}
-									}
-
-								case "exec":
-									for _, path := range config.Paths(config.Path("routes", route, backend, "env")) {
-										if value := strings.TrimSpace(config.String(path)); value != "" {
-											if parts := strings.Split(value, ":"); len(parts) > 1 {
-												env = append(env, parts[0]+"="+matcher.ReplaceAllString(file, strings.TrimSpace(strings.Join(parts[1:], ":"))))
-											}
-										}
-									}
-									tsize, content, _ = b.Exec(target, timeout, env)
-								}
-								if tsize >= 0 {
-									break
-								}
-							}
-							break
-						}
-					}
-				}
-			}
-			if tsize < 0 {
+			source := route.Resolve("tftp", file, timeout)
+			if source == nil {
 				handle.Write(append([]byte{0, 5, 0, 1}, append([]byte("file not found"), 0)...))
 				logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
 					"code": 1, "message": "file not found"})
 				return
 			}
+			defer source.Close()
+			tsize = source.Size
 
-			// send options acknowledgment packet
-			lpacket := make([]byte, 128<<10)
-			lpacket = lpacket[:0]
-			if len(options) > 0 {
-				lpacket = append(lpacket, []byte{0x00, 0x06}...)
-				soptions := ""
-				for name, value := range options {
-					if name == "blksize" {
-						if blksize, _ = strconv.Atoi(value); blksize < 8 || blksize > 65464 {
-							blksize = 512
-							continue
-						}
-					}
-					if name == "timeout" {
-						if timeout, _ = strconv.Atoi(value); timeout < 1 || timeout > 255 {
-							timeout = 5
-							continue
-						}
-					}
-					if name == "tsize" {
-						value = strconv.FormatInt(tsize, 10)
-					}
-					if name == "windowsize" {
-						if wsize, _ = strconv.Atoi(value); wsize < 1 || wsize > 65535 {
-							wsize = 1
-							continue
-						}
-					}
-					lpacket = append(lpacket, []byte(name)...)
-					lpacket = append(lpacket, 0)
-					lpacket = append(lpacket, []byte(value)...)
-					lpacket = append(lpacket, 0)
-					soptions += name + "=" + value
+			// netascii transfers are sized and sent on the translated stream (the source being translated chunk by chunk),
+			// the translated size only being computed upfront when the client asked for it (and otherwise learned when
+			// reaching the end of the source)
+			ssize, soffset, content, buffer, translate, ferr := tsize, int64(0), []byte{}, []byte{}, transfer != "octet", error(nil)
+			fetch := func(offset, length int64) []byte {
+				if int64(cap(buffer)) < length {
+					buffer = make([]byte, length)
 				}
-				if len(lpacket) > 2 {
-					handle.Write(lpacket)
+				read, err := source.ReadAt(buffer[:length], offset)
+				if errors.Is(err, b.ErrChanged) {
+					ferr = err
 				}
+				return buffer[:read]
 			}
+			if _, sized := options["tsize"]; translate && !sized {
+				tsize = math.MaxInt64
 
-			// send requested content
-			toffset, coffset, block, retries := int64(0), int64(0), uint16(0), 0
+			} else if translate {
+				tsize = 0
+				for soffset < ssize {
+					chunk := fetch(soffset, config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20))
+					if len(chunk) == 0 {
+						break
+					}
+					tsize += netascii.Size(chunk)
+					soffset += int64(len(chunk))
+				}
+				soffset = 0
+			}
+
+			// build options acknowledgment packet (sent and acknowledged before any data block, see RFC2347)
+			lpacket, state := make([]byte, 128<<10), stateData
+			oack, blksize, timeout, wsize := negotiate(options, tsize)
+			if len(oack) > 2 {
+				state = stateOptions
+			}
+
+			// send requested content (up to wsize blocks in flight, resuming from the last acknowledged block)
+			toffset, cbase, sent, retries := int64(0), int64(0), 0, 0
 			sstart := time.Now()
 		sloop:
 			for {
 				if retries > 2 {
+					if state == stateOptions {
+						// the client never acknowledged our options: assume it ignored them and fall back to RFC1350 defaults
+						logger.Warn(map[string]any{"scope": "tftp", "event": "options", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
+							"message": "options acknowledgment ignored"})
+						state, blksize, wsize, retries = stateData, 512, 1, 0
+						continue
+					}
 					logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
-						"mode": mode, "size": tsize, "sent": toffset, "code": 0, "message": "retries count exceeded"})
+						"mode": source.Mode, "size": tsize, "sent": toffset, "code": 0, "message": "retries count exceeded"})
 					break sloop
 				}
-				bsize := min(int64(blksize), tsize-toffset)
-				if bsize > 0 && coffset+bsize > int64(len(content)) {
-					if mode == "http" && ftarget != "" {
-						if info, err := os.Stat(ftarget); err == nil && info.Mode().IsRegular() && info.Size() == tsize {
-							mode, target = "file", ftarget
+				sent = 0
+				if state == stateOptions {
+					handle.Write(oack)
+				}
+				for offset := toffset; state == stateData && sent < wsize && offset <= tsize; offset += int64(blksize) {
+					bsize := min(int64(blksize), tsize-offset)
+					if bsize > 0 && (offset < cbase || offset+bsize > cbase+int64(len(content))) {
+						chunk := (config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20) / int64(blksize)) * int64(blksize)
+						if translate {
+							// translated sequences may straddle blocks: keep the unacknowledged translated tail (the whole window
+							// possibly being sent again) and append the next chunk
+							if offset < cbase {
+								content, cbase, soffset = nil, 0, 0
+							}
+							for cbase+int64(len(content)) < offset+bsize && soffset < ssize {
+								if skip := min(toffset-cbase, int64(len(content))); skip > 0 {
+									content, cbase = content[skip:], cbase+skip
+								}
+								raw := fetch(soffset, chunk)
+								if len(raw) == 0 {
+									ssize = soffset
+									break
+								}
+								soffset += int64(len(raw))
+								content = append(content, netascii.Encode(raw)...)
+							}
+							if soffset >= ssize {
+								tsize = min(tsize, cbase+int64(len(content)))
+								if bsize = min(int64(blksize), tsize-offset); bsize < 0 {
+									break
+								}
+							}
+
+						} else {
+							content, cbase = fetch(offset, chunk), offset
 						}
 					}
-					blocks := config.SizeBounds("block_size", 4<<20, 1<<20, 16<<20) / int64(blksize)
-					switch mode {
-					case "file":
-						_, content, _ = b.File(target, toffset, int64(blksize)*blocks)
-
-					case "http":
-						_, content, _ = b.HTTP(target, toffset, int64(blksize)*blocks, timeout, headers)
+					if ferr != nil {
+						// never mix two versions of the content in the same transfer
+						handle.Write(append([]byte{0, 5, 0, 0}, append([]byte(ferr.Error()), 0)...))
+						logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
+							"mode": source.Mode, "size": tsize, "sent": toffset, "code": 0, "message": ferr.Error()})
+						break sloop
+					}
+					lpacket = lpacket[:bsize+4]
+					binary.BigEndian.PutUint16(lpacket[0:], 3)
+					binary.BigEndian.PutUint16(lpacket[2:], uint16((offset/int64(blksize))+1))
+					if bsize > 0 && offset >= cbase && offset+bsize <= cbase+int64(len(content)) {
+						copy(lpacket[4:], content[offset-cbase:offset-cbase+bsize])
+					}
+					handle.Write(lpacket)
+					sent++
+					if bsize < int64(blksize) {
+						break
 					}
-					coffset = 0
-				}
-				lpacket = lpacket[:bsize+4]
-				binary.BigEndian.PutUint16(lpacket[0:], 3)
-				block = uint16(((toffset / int64(blksize)) + 1))
-				binary.BigEndian.PutUint16(lpacket[2:], block)
-				if bsize > 0 && int64(len(content)) >= coffset+bsize {
-					copy(lpacket[4:], content[coffset:coffset+bsize])
 				}
-				handle.Write(lpacket)
 				retries++
 				rstart := time.Now()
 			aloop:
@@ -233,15 +257,24 @@ func Handle(config *uconfig.UConfig, logger *ulog.ULog, packet []byte, local, re
 						opcode := binary.BigEndian.Uint16(lpacket)
 						switch opcode {
 						case 4:
+							if size >= 4 && state == stateOptions {
+								if binary.BigEndian.Uint16(lpacket[2:]) == 0 {
+									state, retries = stateData, 0
+									break aloop
+								}
+								continue
+							}
 							if size >= 4 {
-								if binary.BigEndian.Uint16(lpacket[2:]) == block {
-									toffset += bsize
-									coffset += bsize
+								// acknowledged blocks count within the current window (ignore stale or duplicate acks)
+								first := uint16((toffset / int64(blksize)) + 1)
+								if count := int(binary.BigEndian.Uint16(lpacket[2:])-first) + 1; count >= 1 && count <= sent {
+									next := toffset + int64(count)*int64(blksize)
+									toffset = min(next, tsize)
 									retries = 0
-									if bsize < int64(blksize) {
+									if next > tsize {
 										duration := time.Since(sstart)
 										logger.Info(map[string]any{"scope": "tftp", "event": "response", "local": handle.LocalAddr().String(), "remote": remote,
-											"file": file, "mode": mode, "size": tsize, "sent": toffset, "duration": ustr.Duration(duration),
+											"file": file, "mode": source.Mode, "size": tsize, "sent": toffset, "duration": ustr.Duration(duration),
 											"bandwidth": ustr.Bandwidth((toffset * 8) / int64(duration) / int64(time.Second))})
 										break sloop
 									}
@@ -258,14 +291,20 @@ func Handle(config *uconfig.UConfig, logger *ulog.ULog, packet []byte, local, re
 							if size >= 5 && lpacket[len(lpacket)-1] == 0 {
 								message = string(lpacket[4 : len(lpacket)-1])
 							}
+							if state == stateOptions && code == 8 {
+								// options refused by the client (usually a PXE ROM only probing the file size)
+								logger.Info(map[string]any{"scope": "tftp", "event": "options", "local": handle.LocalAddr().String(), "remote": remote,
+									"file": file, "code": code, "message": message})
+								break sloop
+							}
 							logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote,
-								"file": file, "mode": mode, "size": tsize, "sent": toffset, "code": code, "message": message})
+								"file": file, "mode": source.Mode, "size": tsize, "sent": toffset, "code": code, "message": message})
 							break sloop
 
 						default:
 							handle.Write(append([]byte{0, 5, 0, 4}, append([]byte("illegal TFTP operation"), 0)...))
 							logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote,
-								"file": file, "mode": mode, "size": tsize, "sent": toffset, "code": 4, "message": "illegal TFTP operation" + strconv.Itoa(int(opcode))})
+								"file": file, "mode": source.Mode, "size": tsize, "sent": toffset, "code": 4, "message": "illegal TFTP operation" + strconv.Itoa(int(opcode))})
 							break sloop
 						}
 					}
@@ -274,3 +313,140 @@ func Handle(config *uconfig.UConfig, logger *ulog.ULog, packet []byte, local, re
 		}
 	}
 }
+
+func receive(logger *ulog.ULog, handle *net.UDPConn, remote, file, transfer string, options map[string]string) {
+	// check routes/upload backends and open target
+	var decoder *netascii.Decoder
+
+	tsize := int64(-1)
+	if value, err := strconv.ParseInt(options["tsize"], 10, 64); err == nil && value >= 0 {
+		tsize = value
+	}
+	source, upload, err := route.Upload(file, tsize)
+	if upload == nil {
+		code, message := uint16(2), "access violation"
+		switch {
+		case errors.Is(err, os.ErrExist):
+			code, message = 6, "file already exists"
+
+		case errors.Is(err, b.ErrTooLarge):
+			code, message = 3, "disk full or allocation exceeded"
+		}
+		handle.Write(append([]byte{0, 5, 0, byte(code)}, append([]byte(message), 0)...))
+		logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
+			"code": code, "message": message})
+		return
+	}
+	defer upload.Abort()
+
+	// receive content (acknowledging every wsize in-order blocks, or the last in-order block on timeout or gap)
+	lpacket, block, count, retries, gap := make([]byte, 128<<10), uint16(0), 0, 0, false
+	if transfer != "octet" {
+		decoder = &netascii.Decoder{}
+	}
+	oack, blksize, timeout, wsize := negotiate(options, tsize)
+	acknowledge := func() {
+		if block == 0 && len(oack) > 2 {
+			handle.Write(oack)
+
+		} else {
+			handle.Write([]byte{0, 4, byte(block >> 8), byte(block)})
+		}
+	}
+	acknowledge()
+	rstart := time.Now()
+	for {
+		if retries > 2 {
+			logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
+				"mode": source.Mode, "size": tsize, "received": upload.Size(), "code": 0, "message": "retries count exceeded"})
+			return
+		}
+		lpacket = lpacket[:cap(lpacket)]
+		handle.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		size, _, err := handle.ReadFromUDP(lpacket)
+		if err != nil {
+			retries, count = retries+1, 0
+			acknowledge()
+			continue
+		}
+		if size < 4 {
+			continue
+		}
+		lpacket = lpacket[:size]
+		opcode := binary.BigEndian.Uint16(lpacket)
+		switch opcode {
+		case 3:
+			if binary.BigEndian.Uint16(lpacket[2:]) != block+1 {
+				if !gap {
+					acknowledge()
+				}
+				gap, count = true, 0
+				continue
+			}
+			content := lpacket[4:]
+			if decoder != nil {
+				if content = decoder.Decode(content); size-4 < blksize {
+					content = append(content, decoder.Flush()...)
+				}
+			}
+			if _, err := upload.Write(content); err != nil {
+				message := "disk full or allocation exceeded"
+				if err != b.ErrTooLarge {
+					message += " (" + err.Error() + ")"
+				}
+				handle.Write(append([]byte{0, 5, 0, 3}, append([]byte("disk full or allocation exceeded"), 0)...))
+				logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
+					"mode": source.Mode, "size": tsize, "received": upload.Size(), "code": 3, "message": message})
+				return
+			}
+			block, count, retries, gap = block+1, count+1, 0, false
+			if size-4 < blksize {
+				// the file is put in place before the final acknowledgment, so the client learns about a failed commit
+				if err := upload.Commit(); err != nil {
+					code, message := uint16(0), err.Error()
+					if errors.Is(err, os.ErrExist) {
+						code, message = 6, "file already exists"
+					}
+					handle.Write(append([]byte{0, 5, 0, byte(code)}, append([]byte(message), 0)...))
+					logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote, "file": file,
+						"mode": source.Mode, "size": tsize, "received": upload.Size(), "code": code, "message": message})
+					return
+				}
+				acknowledge()
+				duration := time.Since(rstart)
+				logger.Info(map[string]any{"scope": "tftp", "event": "response", "local": handle.LocalAddr().String(), "remote": remote,
+					"file": file, "mode": source.Mode, "size": tsize, "received": upload.Size(), "duration": ustr.Duration(duration),
+					"bandwidth": ustr.Bandwidth((upload.Size() * 8) / int64(duration) / int64(time.Second))})
+
+				// dally for a while, in case our final acknowledgment gets lost
+				for {
+					lpacket = lpacket[:cap(lpacket)]
+					handle.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+					if size, _, err := handle.ReadFromUDP(lpacket); err != nil || size < 4 || binary.BigEndian.Uint16(lpacket) != 3 {
+						return
+					}
+					acknowledge()
+				}
+			}
+			if count >= wsize {
+				acknowledge()
+				count = 0
+			}
+
+		case 5:
+			code, message := binary.BigEndian.Uint16(lpacket[2:]), ""
+			if size >= 5 && lpacket[len(lpacket)-1] == 0 {
+				message = string(lpacket[4 : len(lpacket)-1])
+			}
+			logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote,
+				"file": file, "mode": source.Mode, "size": tsize, "received": upload.Size(), "code": code, "message": message})
+			return
+
+		default:
+			handle.Write(append([]byte{0, 5, 0, 4}, append([]byte("illegal TFTP operation"), 0)...))
+			logger.Warn(map[string]any{"scope": "tftp", "event": "error", "local": handle.LocalAddr().String(), "remote": remote,
+				"file": file, "mode": source.Mode, "size": tsize, "received": upload.Size(), "code": 4, "message": "illegal TFTP operation" + strconv.Itoa(int(opcode))})
+			return
+		}
+	}
+}